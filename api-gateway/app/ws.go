@@ -0,0 +1,172 @@
+// Package app pushes payment and order events to the WebSocket clients of
+// the gateway. cmd/main.go runs it on RabbitMQ; the end-to-end test in e2e
+// runs it on broker.Memory.
+package app
+
+import (
+	"broker"
+	"context"
+	"fmt"
+	"log"
+	"net/http"
+	"shared/events"
+	"shared/tracing"
+	"sync"
+
+	"github.com/gorilla/websocket"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
+)
+
+type WSHub struct {
+	clients map[int][]*websocket.Conn
+	mu      sync.RWMutex
+}
+
+var hub = WSHub{
+	clients: make(map[int][]*websocket.Conn),
+}
+
+var upgrader = websocket.Upgrader{
+	CheckOrigin: func(r *http.Request) bool {
+		return true
+	},
+}
+
+func (h *WSHub) AddClient(userID int, conn *websocket.Conn) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.clients[userID] = append(h.clients[userID], conn)
+	log.Printf("WebSocket connected: UserID=%d", userID)
+}
+
+func (h *WSHub) RemoveClient(userID int, conn *websocket.Conn) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	conns := h.clients[userID]
+	for i, c := range conns {
+		if c == conn {
+			h.clients[userID] = append(conns[:i], conns[i+1:]...)
+			break
+		}
+	}
+	if len(h.clients[userID]) == 0 {
+		delete(h.clients, userID)
+	}
+	conn.Close()
+	log.Printf("WebSocket disconnected: UserID=%d", userID)
+}
+
+func (h *WSHub) Broadcast(userID int, message []byte) {
+	h.mu.RLock()
+	defer h.mu.RUnlock()
+	conns, ok := h.clients[userID]
+	if !ok {
+		return
+	}
+	for _, conn := range conns {
+		err := conn.WriteMessage(websocket.TextMessage, message)
+		if err != nil {
+			log.Printf("WS write error: %v", err)
+			conn.Close()
+		}
+	}
+}
+
+// StartListener binds a queue private to this gateway to the events pushed
+// to WebSocket clients. The queue is exclusive, so it goes away with the
+// connection and is declared again after a reconnect.
+func StartListener(b broker.Broker) error {
+	queue := "gateway." + events.NewID()
+	topology := broker.Topology{
+		Exchanges: []broker.Exchange{
+			{Name: "payment_events", Kind: broker.Topic},
+			{Name: "order_events", Kind: broker.Topic},
+		},
+		Queues: []broker.Queue{{Name: queue, Exclusive: true}},
+		Bindings: []broker.Binding{
+			// Every payment result is pushed.
+			{Queue: queue, Exchange: "payment_events", RoutingKey: "payments.#"},
+			{Queue: queue, Exchange: "payment_events", RoutingKey: events.RoutingKey("TransferCompleted")},
+			{Queue: queue, Exchange: "payment_events", RoutingKey: events.RoutingKey("AccountWithdrawn")},
+			{Queue: queue, Exchange: "order_events", RoutingKey: events.RoutingKey("OrderCancelled")},
+		},
+	}
+	if err := b.Declare(topology); err != nil {
+		return err
+	}
+	if err := b.Subscribe(queue, 0, handleEvent); err != nil {
+		return err
+	}
+	log.Println("Gateway listening to payment_events and order_events")
+	return nil
+}
+
+func handleEvent(d broker.Delivery) {
+	ctx := tracing.FromHeaders(context.Background(), d.Headers)
+	_, span := tracing.Start(ctx, "push "+d.Type, trace.WithSpanKind(trace.SpanKindConsumer))
+	defer span.End()
+	env, err := events.Parse(d.Body, d.Type, d.ID)
+	if err != nil {
+		log.Printf("Failed to parse event envelope: %v", err)
+		d.Reject(false)
+		return
+	}
+	log.Printf("Gateway received event %s %s (correlation %s): %s", env.EventType, env.EventID, env.CorrelationID, env.Data)
+
+	var event struct {
+		OrderID    int    `json:"order_id"`
+		Status     string `json:"status"`
+		UserID     int    `json:"user_id"`
+		FromUserID int    `json:"from_user_id"`
+		ToUserID   int    `json:"to_user_id"`
+	}
+	if err := env.Decode(&event); err != nil {
+		log.Printf("Failed to unmarshal event: %v", err)
+		d.Reject(false)
+		return
+	}
+	// Clients only get the event data, so the WebSocket message
+	// format did not change with the envelope.
+	if event.UserID != 0 {
+		span.SetAttributes(attribute.Int("user_id", event.UserID))
+		hub.Broadcast(event.UserID, env.Data)
+	}
+	// Transfers concern two users, both of whom get the event.
+	if event.FromUserID != 0 && event.ToUserID != 0 {
+		hub.Broadcast(event.FromUserID, env.Data)
+		hub.Broadcast(event.ToUserID, env.Data)
+	}
+	if err := d.Ack(); err != nil {
+		log.Printf("Failed to ack message: %v", err)
+	}
+}
+
+// WSHandler upgrades the request to a WebSocket that receives the events of
+// the user in the user_id query parameter.
+func WSHandler(w http.ResponseWriter, r *http.Request) {
+	userIDStr := r.URL.Query().Get("user_id")
+	var userID int
+	fmt.Sscanf(userIDStr, "%d", &userID)
+
+	if userID == 0 {
+		http.Error(w, "user_id required", http.StatusBadRequest)
+		return
+	}
+
+	conn, err := upgrader.Upgrade(w, r, nil)
+	if err != nil {
+		log.Printf("WS Upgrade error: %v", err)
+		return
+	}
+
+	hub.AddClient(userID, conn)
+
+	for {
+		_, _, err := conn.ReadMessage()
+		if err != nil {
+			hub.RemoveClient(userID, conn)
+			break
+		}
+	}
+}
@@ -0,0 +1,111 @@
+package broker
+
+import (
+	"context"
+	"errors"
+	"time"
+)
+
+var (
+	// ErrNotConnected means the broker cannot be reached right now; the
+	// message was not published and should be retried later without
+	// counting it as a failed attempt.
+	ErrNotConnected = errors.New("broker is not connected")
+	// ErrUnroutable means no queue is bound to receive the message.
+	ErrUnroutable = errors.New("message is unroutable")
+)
+
+// Message is a message independent of the broker carrying it. An empty
+// Exchange publishes straight to the queue named by RoutingKey.
+type Message struct {
+	Exchange      string
+	RoutingKey    string
+	ID            string
+	Type          string
+	CorrelationID string
+	Headers       map[string]interface{}
+	// Expiration drops the message from the queue it lands in after this
+	// long, dead-lettering it if the queue has a DeadLetter target.
+	Expiration time.Duration
+	Body       []byte
+}
+
+// Delivery is a message handed to a subscriber. Exactly one of Ack or
+// Reject must be called.
+type Delivery struct {
+	Message
+	Ack func() error
+	// Reject returns the message to the queue if requeue is true and
+	// dead-letters or drops it otherwise.
+	Reject func(requeue bool) error
+}
+
+// Publisher publishes messages durably.
+type Publisher interface {
+	// Publish returns once the broker has taken responsibility for every
+	// message, with one error per message: nil for accepted messages.
+	Publish(ctx context.Context, msgs ...Message) []error
+}
+
+// Subscriber delivers messages from a queue to a handler.
+type Subscriber interface {
+	// Subscribe calls handle for every delivery from queue, with at most
+	// prefetch deliveries unacknowledged at a time. handle may hand the
+	// delivery to another goroutine. Subscriptions survive reconnects.
+	Subscribe(queue string, prefetch int, handle func(Delivery)) error
+}
+
+// Broker declares topology and moves messages.
+type Broker interface {
+	Publisher
+	Subscriber
+	// Declare creates the exchanges, queues and bindings of t. It is
+	// idempotent and is replayed after reconnects.
+	Declare(t Topology) error
+	// Connected reports whether messages can currently be published.
+	Connected() bool
+}
+
+type ExchangeKind string
+
+const (
+	Fanout ExchangeKind = "fanout"
+	Direct ExchangeKind = "direct"
+	// Topic routes on dot-separated routing keys. In binding keys * matches
+	// exactly one word and # matches zero or more.
+	Topic ExchangeKind = "topic"
+)
+
+type Exchange struct {
+	Name string
+	Kind ExchangeKind
+}
+
+// DeadLetter is where a queue sends messages that are rejected without
+// requeue or expire. An empty Exchange with a RoutingKey targets a queue
+// directly.
+type DeadLetter struct {
+	Exchange   string
+	RoutingKey string
+}
+
+type Queue struct {
+	Name string
+	// Exclusive queues are private to the declaring connection and go away
+	// with it.
+	Exclusive  bool
+	DeadLetter *DeadLetter
+}
+
+type Binding struct {
+	Queue      string
+	Exchange   string
+	RoutingKey string
+}
+
+// Topology is a set of exchanges, queues and bindings declared together.
+type Topology struct {
+	Exchanges []Exchange
+	Queues    []Queue
+	Bindings  []Binding
+}
@@ -0,0 +1,126 @@
+package deadletter
+
+import (
+	"broker"
+	"context"
+	"fmt"
+	"log"
+	"time"
+)
+
+// Headers added to messages that are retried or parked.
+const (
+	HeaderReason        = "x-failure-reason"
+	HeaderRetryCount    = "x-retry-count"
+	HeaderOriginalQueue = "x-original-queue"
+	HeaderParkedAt      = "x-parked-at"
+)
+
+// ExchangeName is the dead-letter exchange of queue. Everything sent there
+// ends up in ParkingQueue(queue).
+func ExchangeName(queue string) string { return queue + ".dlx" }
+
+// ParkingQueue holds messages of queue that will not be retried automatically.
+func ParkingQueue(queue string) string { return queue + ".parking" }
+
+// RetryQueue holds messages of queue waiting for their next attempt. They
+// have no consumer and flow back into queue once their expiration passes.
+func RetryQueue(queue string) string { return queue + ".retry" }
+
+// DeadLetterTarget must be set on queue by everyone declaring it, so
+// deliveries the broker rejects or drops end up in the parking lot as well.
+func DeadLetterTarget(queue string) *broker.DeadLetter {
+	return &broker.DeadLetter{Exchange: ExchangeName(queue)}
+}
+
+// Topology is the dead-letter exchange, the parking queue and the retry
+// queue of queue.
+func Topology(queue string) broker.Topology {
+	return broker.Topology{
+		Exchanges: []broker.Exchange{{Name: ExchangeName(queue), Kind: broker.Fanout}},
+		Queues: []broker.Queue{
+			{Name: ParkingQueue(queue)},
+			{Name: RetryQueue(queue), DeadLetter: &broker.DeadLetter{RoutingKey: queue}},
+		},
+		Bindings: []broker.Binding{{Queue: ParkingQueue(queue), Exchange: ExchangeName(queue)}},
+	}
+}
+
+// Handler takes failed deliveries of one queue off the hot path: transient
+// failures are retried after a delay instead of being requeued in a tight
+// loop, and poison messages are parked with the reason in their headers.
+type Handler struct {
+	publisher  broker.Publisher
+	queue      string
+	maxRetries int
+	retryDelay time.Duration
+}
+
+func NewHandler(publisher broker.Publisher, queue string, maxRetries int, retryDelay time.Duration) *Handler {
+	return &Handler{publisher: publisher, queue: queue, maxRetries: maxRetries, retryDelay: retryDelay}
+}
+
+// Park moves d to the parking lot and acks it.
+func (h *Handler) Park(d broker.Delivery, reason error) {
+	log.Printf("dead letter: parking %s %s from %s: %v", d.Type, d.ID, h.queue, reason)
+	m := d.Message
+	m.Exchange = ExchangeName(h.queue)
+	m.RoutingKey = ""
+	m.Headers = copyHeaders(d.Headers)
+	m.Headers[HeaderReason] = reason.Error()
+	m.Headers[HeaderOriginalQueue] = h.queue
+	m.Headers[HeaderParkedAt] = time.Now().UTC().Format(time.RFC3339)
+	h.forward(d, m)
+}
+
+// Retry schedules d for another attempt after the retry delay, or parks it
+// once it has been retried maxRetries times.
+func (h *Handler) Retry(d broker.Delivery, cause error) {
+	retries := RetryCount(d.Headers)
+	if retries >= h.maxRetries {
+		h.Park(d, fmt.Errorf("gave up after %d retries: %w", retries, cause))
+		return
+	}
+	log.Printf("dead letter: retry %d/%d of %s %s in %s: %v", retries+1, h.maxRetries, d.Type, d.ID, h.retryDelay, cause)
+	m := d.Message
+	m.Exchange = ""
+	m.RoutingKey = RetryQueue(h.queue)
+	m.Headers = copyHeaders(d.Headers)
+	m.Headers[HeaderReason] = cause.Error()
+	m.Headers[HeaderRetryCount] = int32(retries + 1)
+	m.Expiration = h.retryDelay
+	h.forward(d, m)
+}
+
+// forward publishes m and acks d. If m cannot be published, d is rejected
+// without requeue, which still dead-letters it through the queue's
+// dead-letter target.
+func (h *Handler) forward(d broker.Delivery, m broker.Message) {
+	if err := h.publisher.Publish(context.Background(), m)[0]; err != nil {
+		log.Printf("dead letter: forward %s failed, rejecting: %v", d.ID, err)
+		d.Reject(false)
+		return
+	}
+	d.Ack()
+}
+
+// RetryCount returns how many times a message has been retried so far.
+func RetryCount(headers map[string]interface{}) int {
+	switch n := headers[HeaderRetryCount].(type) {
+	case int32:
+		return int(n)
+	case int64:
+		return int(n)
+	case int:
+		return n
+	}
+	return 0
+}
+
+func copyHeaders(headers map[string]interface{}) map[string]interface{} {
+	out := make(map[string]interface{}, len(headers)+4)
+	for k, v := range headers {
+		out[k] = v
+	}
+	return out
+}
@@ -0,0 +1,154 @@
+package deadletter
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"time"
+
+	amqp "github.com/rabbitmq/amqp091-go"
+)
+
+var ErrParkedMessageNotFound = errors.New("parked message not found")
+
+type ParkedMessage struct {
+	MessageID     string          `json:"message_id"`
+	Type          string          `json:"type"`
+	Reason        string          `json:"reason"`
+	RetryCount    int             `json:"retry_count"`
+	OriginalQueue string          `json:"original_queue"`
+	ParkedAt      string          `json:"parked_at,omitempty"`
+	Body          json.RawMessage `json:"body"`
+}
+
+// ChannelOpener opens AMQP channels; both *amqp.Connection and
+// rabbitmq.Manager satisfy it.
+type ChannelOpener interface {
+	Channel() (*amqp.Channel, error)
+}
+
+// ParkingLot lets operators browse and replay the parking queue of one
+// queue. Unlike Handler it talks to RabbitMQ directly, since browsing relies
+// on basic.get: it gets messages without acking them and closes the channel
+// afterwards, which puts them back; concurrent operators may therefore see
+// messages in a different order.
+type ParkingLot struct {
+	conn  ChannelOpener
+	queue string
+}
+
+func NewParkingLot(conn ChannelOpener, queue string) *ParkingLot {
+	return &ParkingLot{conn: conn, queue: queue}
+}
+
+// List returns up to limit parked messages, oldest first.
+func (p *ParkingLot) List(limit int) ([]ParkedMessage, error) {
+	parked := []ParkedMessage{}
+	err := p.browse(func(d amqp.Delivery) bool {
+		parked = append(parked, p.toParked(d))
+		return len(parked) < limit
+	})
+	return parked, err
+}
+
+// Replay publishes the parked message with messageID back to the original
+// queue with a fresh retry budget and removes it from the parking lot. A
+// non-nil body replaces the original one, so a message can be fixed before it
+// is replayed.
+func (p *ParkingLot) Replay(messageID string, body []byte) error {
+	ch, err := p.conn.Channel()
+	if err != nil {
+		return fmt.Errorf("open channel: %w", err)
+	}
+	defer ch.Close()
+	found := false
+	var replayErr error
+	err = p.browseOn(ch, func(d amqp.Delivery) bool {
+		if d.MessageId != messageID {
+			return true
+		}
+		found = true
+		if body == nil {
+			body = d.Body
+		}
+		headers := copyHeaders(d.Headers)
+		delete(headers, HeaderRetryCount)
+		delete(headers, HeaderReason)
+		delete(headers, HeaderParkedAt)
+		headers["x-replayed-at"] = time.Now().UTC().Format(time.RFC3339)
+		replayErr = ch.Publish("", p.queue, false, false, amqp.Publishing{
+			Headers:       amqp.Table(headers),
+			ContentType:   d.ContentType,
+			DeliveryMode:  amqp.Persistent,
+			MessageId:     d.MessageId,
+			CorrelationId: d.CorrelationId,
+			Type:          d.Type,
+			Body:          body,
+		})
+		if replayErr == nil {
+			replayErr = d.Ack(false)
+		}
+		return false
+	})
+	if err == nil {
+		err = replayErr
+	}
+	if err != nil {
+		return fmt.Errorf("replay parked message error: %w", err)
+	}
+	if !found {
+		return ErrParkedMessageNotFound
+	}
+	return nil
+}
+
+func (p *ParkingLot) browse(visit func(amqp.Delivery) bool) error {
+	ch, err := p.conn.Channel()
+	if err != nil {
+		return fmt.Errorf("open channel: %w", err)
+	}
+	defer ch.Close()
+	return p.browseOn(ch, visit)
+}
+
+// browseOn gets parked messages one by one until visit returns false or every
+// message present at the start has been seen. Unacked messages return to the
+// queue when ch is closed.
+func (p *ParkingLot) browseOn(ch *amqp.Channel, visit func(amqp.Delivery) bool) error {
+	q, err := ch.QueueDeclarePassive(ParkingQueue(p.queue), true, false, false, false, nil)
+	if err != nil {
+		return fmt.Errorf("inspect parking queue: %w", err)
+	}
+	for i := 0; i < q.Messages; i++ {
+		d, ok, err := ch.Get(q.Name, false)
+		if err != nil {
+			return fmt.Errorf("get parked message: %w", err)
+		}
+		if !ok || !visit(d) {
+			return nil
+		}
+	}
+	return nil
+}
+
+func (p *ParkingLot) toParked(d amqp.Delivery) ParkedMessage {
+	m := ParkedMessage{
+		MessageID:  d.MessageId,
+		Type:       d.Type,
+		RetryCount: RetryCount(d.Headers),
+		Body:       d.Body,
+	}
+	m.Reason, _ = d.Headers[HeaderReason].(string)
+	m.OriginalQueue, _ = d.Headers[HeaderOriginalQueue].(string)
+	m.ParkedAt, _ = d.Headers[HeaderParkedAt].(string)
+	if m.OriginalQueue == "" {
+		// Dead-lettered by the broker itself rather than by a Handler.
+		m.OriginalQueue = p.queue
+		m.Reason = "rejected by consumer or broker"
+	}
+	if !json.Valid(d.Body) {
+		// Keep the response valid JSON for bodies that are not.
+		m.Body, _ = json.Marshal(string(d.Body))
+	}
+	return m
+}
@@ -0,0 +1,277 @@
+package broker
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Memory is an in-process Broker with the RabbitMQ semantics the services
+// rely on: fanout, direct, topic and default-exchange routing, prefetch,
+// requeue, dead-lettering of rejected and expired messages. Messages are lost
+// with the process, so it is meant for tests and local experiments.
+type Memory struct {
+	mu        sync.Mutex
+	exchanges map[string]ExchangeKind
+	queues    map[string]*memoryQueue
+	bindings  []Binding
+	closed    bool
+}
+
+type memoryQueue struct {
+	deadLetter *DeadLetter
+	ready      []*memoryMessage
+	cond       *sync.Cond
+}
+
+type memoryMessage struct {
+	Message
+	taken bool
+}
+
+func NewMemory() *Memory {
+	return &Memory{
+		exchanges: make(map[string]ExchangeKind),
+		queues:    make(map[string]*memoryQueue),
+	}
+}
+
+func (b *Memory) Connected() bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return !b.closed
+}
+
+// Close stops all subscriptions. Unacknowledged deliveries can still be
+// acked or rejected but are not redelivered.
+func (b *Memory) Close() {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.closed = true
+	for _, q := range b.queues {
+		q.cond.Broadcast()
+	}
+}
+
+func (b *Memory) Declare(t Topology) error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	for _, e := range t.Exchanges {
+		if kind, ok := b.exchanges[e.Name]; ok && kind != e.Kind {
+			return fmt.Errorf("exchange %s already declared as %s", e.Name, kind)
+		}
+		b.exchanges[e.Name] = e.Kind
+	}
+	for _, q := range t.Queues {
+		if _, ok := b.queues[q.Name]; ok {
+			continue
+		}
+		b.queues[q.Name] = &memoryQueue{deadLetter: q.DeadLetter, cond: sync.NewCond(&b.mu)}
+	}
+	for _, bnd := range t.Bindings {
+		if _, ok := b.exchanges[bnd.Exchange]; !ok {
+			return fmt.Errorf("bind %s: exchange %s not declared", bnd.Queue, bnd.Exchange)
+		}
+		if _, ok := b.queues[bnd.Queue]; !ok {
+			return fmt.Errorf("bind %s: queue not declared", bnd.Queue)
+		}
+		if !b.bound(bnd) {
+			b.bindings = append(b.bindings, bnd)
+		}
+	}
+	return nil
+}
+
+func (b *Memory) bound(bnd Binding) bool {
+	for _, existing := range b.bindings {
+		if existing == bnd {
+			return true
+		}
+	}
+	return false
+}
+
+func (b *Memory) Publish(ctx context.Context, msgs ...Message) []error {
+	errs := make([]error, len(msgs))
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	for i, m := range msgs {
+		if b.closed {
+			errs[i] = ErrNotConnected
+			continue
+		}
+		errs[i] = b.route(m)
+	}
+	return errs
+}
+
+// route enqueues a copy of m in every queue it is routed to.
+func (b *Memory) route(m Message) error {
+	var targets []string
+	if m.Exchange == "" {
+		if _, ok := b.queues[m.RoutingKey]; ok {
+			targets = append(targets, m.RoutingKey)
+		}
+	} else {
+		kind, ok := b.exchanges[m.Exchange]
+		if !ok {
+			return fmt.Errorf("exchange %s not declared", m.Exchange)
+		}
+		for _, bnd := range b.bindings {
+			if bnd.Exchange == m.Exchange && matches(kind, bnd.RoutingKey, m.RoutingKey) && !contains(targets, bnd.Queue) {
+				targets = append(targets, bnd.Queue)
+			}
+		}
+	}
+	if len(targets) == 0 {
+		return ErrUnroutable
+	}
+	for _, name := range targets {
+		b.enqueue(b.queues[name], m)
+	}
+	return nil
+}
+
+func matches(kind ExchangeKind, bindingKey, routingKey string) bool {
+	switch kind {
+	case Fanout:
+		return true
+	case Topic:
+		return topicMatch(strings.Split(bindingKey, "."), strings.Split(routingKey, "."))
+	default:
+		return bindingKey == routingKey
+	}
+}
+
+func topicMatch(pattern, words []string) bool {
+	if len(pattern) == 0 {
+		return len(words) == 0
+	}
+	switch pattern[0] {
+	case "#":
+		for i := 0; i <= len(words); i++ {
+			if topicMatch(pattern[1:], words[i:]) {
+				return true
+			}
+		}
+		return false
+	case "*":
+		return len(words) > 0 && topicMatch(pattern[1:], words[1:])
+	default:
+		return len(words) > 0 && pattern[0] == words[0] && topicMatch(pattern[1:], words[1:])
+	}
+}
+
+func contains(names []string, name string) bool {
+	for _, n := range names {
+		if n == name {
+			return true
+		}
+	}
+	return false
+}
+
+func (b *Memory) enqueue(q *memoryQueue, m Message) {
+	if m.Headers != nil {
+		headers := make(map[string]interface{}, len(m.Headers))
+		for k, v := range m.Headers {
+			headers[k] = v
+		}
+		m.Headers = headers
+	}
+	msg := &memoryMessage{Message: m}
+	q.ready = append(q.ready, msg)
+	q.cond.Broadcast()
+	if m.Expiration > 0 {
+		time.AfterFunc(m.Expiration, func() {
+			b.mu.Lock()
+			defer b.mu.Unlock()
+			if msg.taken {
+				return
+			}
+			for i, ready := range q.ready {
+				if ready == msg {
+					q.ready = append(q.ready[:i], q.ready[i+1:]...)
+					break
+				}
+			}
+			b.deadLetter(q, msg.Message)
+		})
+	}
+}
+
+// deadLetter forwards m to the dead-letter target of q. Like RabbitMQ it
+// drops the expiration, so an expired message does not expire again.
+func (b *Memory) deadLetter(q *memoryQueue, m Message) {
+	if q.deadLetter == nil {
+		return
+	}
+	m.Exchange = q.deadLetter.Exchange
+	if q.deadLetter.RoutingKey != "" {
+		m.RoutingKey = q.deadLetter.RoutingKey
+	}
+	m.Expiration = 0
+	_ = b.route(m)
+}
+
+func (b *Memory) Subscribe(queue string, prefetch int, handle func(Delivery)) error {
+	b.mu.Lock()
+	q, ok := b.queues[queue]
+	b.mu.Unlock()
+	if !ok {
+		return fmt.Errorf("queue %s not declared", queue)
+	}
+	go b.consume(q, prefetch, handle)
+	return nil
+}
+
+func (b *Memory) consume(q *memoryQueue, prefetch int, handle func(Delivery)) {
+	unacked := 0
+	for {
+		b.mu.Lock()
+		for !b.closed && (len(q.ready) == 0 || (prefetch > 0 && unacked >= prefetch)) {
+			q.cond.Wait()
+		}
+		if b.closed {
+			b.mu.Unlock()
+			return
+		}
+		msg := q.ready[0]
+		q.ready = q.ready[1:]
+		msg.taken = true
+		unacked++
+		b.mu.Unlock()
+
+		var once sync.Once
+		settle := func(f func()) error {
+			settled := false
+			once.Do(func() {
+				b.mu.Lock()
+				defer b.mu.Unlock()
+				unacked--
+				f()
+				q.cond.Broadcast()
+				settled = true
+			})
+			if !settled {
+				return fmt.Errorf("delivery %s already settled", msg.ID)
+			}
+			return nil
+		}
+		handle(Delivery{
+			Message: msg.Message,
+			Ack:     func() error { return settle(func() {}) },
+			Reject: func(requeue bool) error {
+				return settle(func() {
+					if requeue {
+						q.ready = append([]*memoryMessage{{Message: msg.Message}}, q.ready...)
+						return
+					}
+					b.deadLetter(q, msg.Message)
+				})
+			},
+		})
+	}
+}
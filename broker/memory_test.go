@@ -0,0 +1,236 @@
+package broker
+
+import (
+	"context"
+	"errors"
+	"strings"
+	"testing"
+	"time"
+)
+
+// waitFor bounds how long the tests wait for an asynchronous delivery.
+const waitFor = 2 * time.Second
+
+func TestTopicMatch(t *testing.T) {
+	tests := []struct {
+		pattern, key string
+		want         bool
+	}{
+		{"orders.created", "orders.created", true},
+		{"orders.created", "orders.cancelled", false},
+		{"orders.*", "orders.created", true},
+		{"orders.*", "orders", false},
+		{"orders.*", "orders.created.late", false},
+		{"*.created", "orders.created", true},
+		{"payments.#", "payments.succeeded", true},
+		{"payments.#", "payments", true},
+		{"payments.#", "payments.refunded.partial", true},
+		{"payments.#", "orders.created", false},
+		{"#", "anything.at.all", true},
+		{"#.created", "orders.created", true},
+		{"#.created", "orders.cancelled", false},
+		{"orders.#.late", "orders.late", true},
+		{"orders.#.late", "orders.created.again.late", true},
+	}
+	for _, tt := range tests {
+		got := topicMatch(strings.Split(tt.pattern, "."), strings.Split(tt.key, "."))
+		if got != tt.want {
+			t.Errorf("topicMatch(%q, %q) = %t, want %t", tt.pattern, tt.key, got, tt.want)
+		}
+	}
+}
+
+func TestMemoryRouting(t *testing.T) {
+	b := NewMemory()
+	defer b.Close()
+	err := b.Declare(Topology{
+		Exchanges: []Exchange{
+			{Name: "fan", Kind: Fanout},
+			{Name: "direct", Kind: Direct},
+			{Name: "topic", Kind: Topic},
+		},
+		Queues: []Queue{{Name: "a"}, {Name: "b"}},
+		Bindings: []Binding{
+			{Queue: "a", Exchange: "fan"},
+			{Queue: "b", Exchange: "fan"},
+			{Queue: "a", Exchange: "direct", RoutingKey: "key"},
+			{Queue: "a", Exchange: "topic", RoutingKey: "orders.*"},
+			{Queue: "b", Exchange: "topic", RoutingKey: "#"},
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		msg  Message
+		want []string
+		err  error
+	}{
+		{Message{Exchange: "fan", RoutingKey: "ignored"}, []string{"a", "b"}, nil},
+		{Message{Exchange: "direct", RoutingKey: "key"}, []string{"a"}, nil},
+		{Message{Exchange: "direct", RoutingKey: "other"}, nil, ErrUnroutable},
+		{Message{Exchange: "topic", RoutingKey: "orders.created"}, []string{"a", "b"}, nil},
+		{Message{Exchange: "topic", RoutingKey: "payments.failed"}, []string{"b"}, nil},
+		// The default exchange routes straight to the queue.
+		{Message{RoutingKey: "b"}, []string{"b"}, nil},
+		{Message{RoutingKey: "missing"}, nil, ErrUnroutable},
+	}
+	for _, tt := range tests {
+		if err := b.Publish(context.Background(), tt.msg)[0]; !errors.Is(err, tt.err) {
+			t.Errorf("publish to %q/%q: got %v, want %v", tt.msg.Exchange, tt.msg.RoutingKey, err, tt.err)
+			continue
+		}
+		for _, name := range []string{"a", "b"} {
+			got := b.drain(name)
+			if want := contains(tt.want, name); (got == 1) != want {
+				t.Errorf("publish to %q/%q: queue %s got %d messages, want routed: %t",
+					tt.msg.Exchange, tt.msg.RoutingKey, name, got, want)
+			}
+		}
+	}
+	if err := b.Publish(context.Background(), Message{Exchange: "undeclared"})[0]; err == nil {
+		t.Error("publish to an undeclared exchange succeeded")
+	}
+}
+
+// drain empties queue and returns how many messages it held.
+func (b *Memory) drain(queue string) int {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	q := b.queues[queue]
+	n := len(q.ready)
+	q.ready = nil
+	return n
+}
+
+func TestMemoryPrefetch(t *testing.T) {
+	b := NewMemory()
+	defer b.Close()
+	if err := b.Declare(Topology{Queues: []Queue{{Name: "q"}}}); err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 5; i++ {
+		if err := b.Publish(context.Background(), Message{RoutingKey: "q"})[0]; err != nil {
+			t.Fatal(err)
+		}
+	}
+	deliveries := make(chan Delivery, 5)
+	if err := b.Subscribe("q", 2, func(d Delivery) { deliveries <- d }); err != nil {
+		t.Fatal(err)
+	}
+	first, second := receive(t, deliveries), receive(t, deliveries)
+	select {
+	case <-deliveries:
+		t.Fatal("got a third delivery with prefetch 2 and none acked")
+	case <-time.After(50 * time.Millisecond):
+	}
+	if err := first.Ack(); err != nil {
+		t.Fatal(err)
+	}
+	receive(t, deliveries)
+	if err := second.Ack(); err != nil {
+		t.Fatal(err)
+	}
+	receive(t, deliveries)
+}
+
+func TestMemoryRequeue(t *testing.T) {
+	b := NewMemory()
+	defer b.Close()
+	if err := b.Declare(Topology{Queues: []Queue{{Name: "q"}}}); err != nil {
+		t.Fatal(err)
+	}
+	if err := b.Publish(context.Background(), Message{RoutingKey: "q", ID: "m1"})[0]; err != nil {
+		t.Fatal(err)
+	}
+	deliveries := make(chan Delivery, 2)
+	if err := b.Subscribe("q", 1, func(d Delivery) { deliveries <- d }); err != nil {
+		t.Fatal(err)
+	}
+	d := receive(t, deliveries)
+	if err := d.Reject(true); err != nil {
+		t.Fatal(err)
+	}
+	if err := d.Ack(); err == nil {
+		t.Error("a settled delivery was acked again")
+	}
+	if again := receive(t, deliveries); again.ID != "m1" {
+		t.Fatalf("redelivered %q, want m1", again.ID)
+	}
+}
+
+func TestMemoryDeadLetter(t *testing.T) {
+	b := NewMemory()
+	defer b.Close()
+	err := b.Declare(Topology{
+		Exchanges: []Exchange{{Name: "dlx", Kind: Fanout}},
+		Queues: []Queue{
+			{Name: "work", DeadLetter: &DeadLetter{Exchange: "dlx"}},
+			{Name: "parked"},
+		},
+		Bindings: []Binding{{Queue: "parked", Exchange: "dlx"}},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	parked := make(chan Delivery, 2)
+	if err := b.Subscribe("parked", 0, func(d Delivery) { parked <- d }); err != nil {
+		t.Fatal(err)
+	}
+
+	// A rejected message is dead-lettered.
+	err = b.Publish(context.Background(), Message{RoutingKey: "work", ID: "rejected", Headers: map[string]interface{}{"k": "v"}})[0]
+	if err != nil {
+		t.Fatal(err)
+	}
+	work := make(chan Delivery, 1)
+	if err := b.Subscribe("work", 1, func(d Delivery) { work <- d }); err != nil {
+		t.Fatal(err)
+	}
+	if err := receive(t, work).Reject(false); err != nil {
+		t.Fatal(err)
+	}
+	if d := receive(t, parked); d.ID != "rejected" || d.Headers["k"] != "v" {
+		t.Fatalf("parked %q with headers %v", d.ID, d.Headers)
+	}
+
+	// An expired message is dead-lettered without its expiration. The
+	// consumer of work takes "held" and, with prefetch 1 and no ack, leaves
+	// "expired" in the queue until it expires.
+	err = b.Publish(context.Background(),
+		Message{RoutingKey: "work", ID: "held"},
+		Message{RoutingKey: "work", ID: "expired", Expiration: 20 * time.Millisecond},
+	)[0]
+	if err != nil {
+		t.Fatal(err)
+	}
+	receive(t, work)
+	if d := receive(t, parked); d.ID != "expired" || d.Expiration != 0 {
+		t.Fatalf("parked %q with expiration %s", d.ID, d.Expiration)
+	}
+}
+
+func TestMemoryClosed(t *testing.T) {
+	b := NewMemory()
+	if err := b.Declare(Topology{Queues: []Queue{{Name: "q"}}}); err != nil {
+		t.Fatal(err)
+	}
+	b.Close()
+	if b.Connected() {
+		t.Error("closed broker reports connected")
+	}
+	if err := b.Publish(context.Background(), Message{RoutingKey: "q"})[0]; !errors.Is(err, ErrNotConnected) {
+		t.Errorf("publish after close: got %v, want ErrNotConnected", err)
+	}
+}
+
+func receive(t *testing.T, deliveries <-chan Delivery) Delivery {
+	t.Helper()
+	select {
+	case d := <-deliveries:
+		return d
+	case <-time.After(waitFor):
+		t.Fatal("no delivery")
+		return Delivery{}
+	}
+}
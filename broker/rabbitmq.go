@@ -0,0 +1,259 @@
+package broker
+
+import (
+	"broker/rabbitmq"
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	amqp "github.com/rabbitmq/amqp091-go"
+)
+
+// confirmTimeout bounds how long Publish waits for publisher confirms when
+// the caller's context has no deadline.
+const confirmTimeout = 5 * time.Second
+
+// RabbitMQ is the Broker backed by a rabbitmq.Manager. Topology and
+// subscriptions are registered with the manager, so they are restored after
+// every reconnect.
+type RabbitMQ struct {
+	manager *rabbitmq.Manager
+
+	mu      sync.Mutex
+	ch      *amqp.Channel
+	returns chan amqp.Return
+	// publisherUp is false while the publisher channel is closed, without
+	// waiting for mu, which Publish holds until the broker confirms.
+	publisherUp atomic.Bool
+
+	consumersMu sync.Mutex
+	// consuming tells for every subscribed queue whether its consumer is
+	// currently running.
+	consuming map[string]bool
+}
+
+func NewRabbitMQ(manager *rabbitmq.Manager) (*RabbitMQ, error) {
+	b := &RabbitMQ{manager: manager, consuming: make(map[string]bool)}
+	if err := manager.OnConnect(b.setupPublisher); err != nil {
+		return nil, err
+	}
+	return b, nil
+}
+
+// setupPublisher swaps in a new confirm-mode channel for Publish. If the
+// broker closes the channel while conn stays up, it is set up again.
+func (b *RabbitMQ) setupPublisher(conn *amqp.Connection) error {
+	ch, err := conn.Channel()
+	if err != nil {
+		return err
+	}
+	if err := ch.Confirm(false); err != nil {
+		return err
+	}
+	closed := ch.NotifyClose(make(chan *amqp.Error, 1))
+	b.mu.Lock()
+	b.ch = ch
+	b.returns = ch.NotifyReturn(make(chan amqp.Return, 64))
+	b.mu.Unlock()
+	b.publisherUp.Store(true)
+	go func() {
+		reason, ok := <-closed
+		if !ok {
+			return
+		}
+		b.publisherUp.Store(false)
+		log.Printf("broker: publisher channel closed: %v", reason)
+		b.manager.Reopen(conn, "publisher channel", b.setupPublisher)
+	}()
+	return nil
+}
+
+// Connected reports whether the connection, the publisher channel and every
+// consumer are up.
+func (b *RabbitMQ) Connected() bool {
+	if !b.manager.Connected() || !b.publisherUp.Load() {
+		return false
+	}
+	b.consumersMu.Lock()
+	defer b.consumersMu.Unlock()
+	for _, up := range b.consuming {
+		if !up {
+			return false
+		}
+	}
+	return true
+}
+
+func (b *RabbitMQ) setConsuming(queue string, up bool) {
+	b.consumersMu.Lock()
+	b.consuming[queue] = up
+	b.consumersMu.Unlock()
+}
+
+func (b *RabbitMQ) Declare(t Topology) error {
+	return b.manager.OnConnect(func(conn *amqp.Connection) error {
+		ch, err := conn.Channel()
+		if err != nil {
+			return err
+		}
+		defer ch.Close()
+		return declare(ch, t)
+	})
+}
+
+func declare(ch *amqp.Channel, t Topology) error {
+	for _, e := range t.Exchanges {
+		if err := ch.ExchangeDeclare(e.Name, string(e.Kind), true, false, false, false, nil); err != nil {
+			return fmt.Errorf("declare exchange %s: %w", e.Name, err)
+		}
+	}
+	for _, q := range t.Queues {
+		var args amqp.Table
+		if q.DeadLetter != nil {
+			args = amqp.Table{"x-dead-letter-exchange": q.DeadLetter.Exchange}
+			if q.DeadLetter.RoutingKey != "" {
+				args["x-dead-letter-routing-key"] = q.DeadLetter.RoutingKey
+			}
+		}
+		if _, err := ch.QueueDeclare(q.Name, !q.Exclusive, q.Exclusive, q.Exclusive, false, args); err != nil {
+			return fmt.Errorf("declare queue %s: %w", q.Name, err)
+		}
+	}
+	for _, bnd := range t.Bindings {
+		if err := ch.QueueBind(bnd.Queue, bnd.RoutingKey, bnd.Exchange, false, nil); err != nil {
+			return fmt.Errorf("bind %s to %s: %w", bnd.Queue, bnd.Exchange, err)
+		}
+	}
+	return nil
+}
+
+// Publish publishes msgs as persistent mandatory messages and waits for the
+// broker to confirm all of them at once. Returned (unroutable) messages get
+// ErrUnroutable.
+func (b *RabbitMQ) Publish(ctx context.Context, msgs ...Message) []error {
+	errs := make([]error, len(msgs))
+	// One batch at a time, so the returns drained below belong to it.
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.ch == nil || b.ch.IsClosed() {
+		for i := range errs {
+			errs[i] = ErrNotConnected
+		}
+		return errs
+	}
+	confirms := make([]*amqp.DeferredConfirmation, len(msgs))
+	for i, m := range msgs {
+		var expiration string
+		if m.Expiration > 0 {
+			expiration = strconv.FormatInt(m.Expiration.Milliseconds(), 10)
+		}
+		dc, err := b.ch.PublishWithDeferredConfirm(
+			m.Exchange,
+			m.RoutingKey,
+			true,
+			false,
+			amqp.Publishing{
+				Headers:       amqp.Table(m.Headers),
+				ContentType:   "application/json",
+				DeliveryMode:  amqp.Persistent,
+				MessageId:     m.ID,
+				CorrelationId: m.CorrelationID,
+				Type:          m.Type,
+				Expiration:    expiration,
+				Body:          m.Body,
+			},
+		)
+		if err != nil {
+			errs[i] = fmt.Errorf("publish: %w", err)
+			continue
+		}
+		confirms[i] = dc
+	}
+
+	if _, ok := ctx.Deadline(); !ok {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, confirmTimeout)
+		defer cancel()
+	}
+	for i, dc := range confirms {
+		if dc == nil {
+			continue
+		}
+		ok, err := dc.WaitContext(ctx)
+		if err != nil {
+			errs[i] = fmt.Errorf("no confirm from broker: %w", err)
+		} else if !ok {
+			errs[i] = errors.New("nacked by broker")
+		}
+	}
+
+	// The broker sends basic.return before the ack of the same message, so
+	// every return for this batch is already buffered once all acks are in.
+	returned := make(map[string]amqp.Return)
+	for len(b.returns) > 0 {
+		r := <-b.returns
+		returned[r.MessageId] = r
+	}
+	for i, m := range msgs {
+		if r, ok := returned[m.ID]; ok && errs[i] == nil {
+			errs[i] = fmt.Errorf("%w: %d %s", ErrUnroutable, r.ReplyCode, r.ReplyText)
+		}
+	}
+	return errs
+}
+
+// Subscribe consumes queue on its own channel, which is reopened after every
+// reconnect and whenever the broker closes it on its own.
+func (b *RabbitMQ) Subscribe(queue string, prefetch int, handle func(Delivery)) error {
+	var consume rabbitmq.SetupFunc
+	consume = func(conn *amqp.Connection) error {
+		ch, err := conn.Channel()
+		if err != nil {
+			return err
+		}
+		if err := ch.Qos(prefetch, 0, false); err != nil {
+			ch.Close()
+			return err
+		}
+		deliveries, err := ch.Consume(queue, "", false, false, false, false, nil)
+		if err != nil {
+			ch.Close()
+			return err
+		}
+		b.setConsuming(queue, true)
+		go func() {
+			for d := range deliveries {
+				handle(toDelivery(d))
+			}
+			b.setConsuming(queue, false)
+			log.Printf("broker: delivery channel of %s closed", queue)
+			// The consumer may have been cancelled on a channel that is
+			// still open.
+			ch.Close()
+			b.manager.Reopen(conn, "consumer of "+queue, consume)
+		}()
+		return nil
+	}
+	return b.manager.OnConnect(consume)
+}
+
+func toDelivery(d amqp.Delivery) Delivery {
+	return Delivery{
+		Message: Message{
+			Exchange:      d.Exchange,
+			RoutingKey:    d.RoutingKey,
+			ID:            d.MessageId,
+			Type:          d.Type,
+			CorrelationID: d.CorrelationId,
+			Headers:       d.Headers,
+			Body:          d.Body,
+		},
+		Ack:    func() error { return d.Ack(false) },
+		Reject: func(requeue bool) error { return d.Nack(false, requeue) },
+	}
+}
@@ -0,0 +1,188 @@
+package rabbitmq
+
+import (
+	"errors"
+	"log"
+	"sync"
+	"time"
+
+	amqp "github.com/rabbitmq/amqp091-go"
+)
+
+var ErrNotConnected = errors.New("rabbitmq is not connected")
+
+const (
+	minRedialDelay = time.Second
+	maxRedialDelay = 30 * time.Second
+)
+
+// SetupFunc declares topology and opens the channels a component needs on a
+// fresh connection. It runs after every (re)connect.
+type SetupFunc func(conn *amqp.Connection) error
+
+// Manager owns the RabbitMQ connection of a service. It re-dials with
+// backoff whenever the connection is closed and runs every registered
+// SetupFunc again, so consumers are restarted and publishers get new channels
+// without the service being restarted. A channel the broker closes on its own
+// is reopened by its owner through Reopen.
+type Manager struct {
+	url string
+
+	mu     sync.RWMutex
+	conn   *amqp.Connection
+	setups []SetupFunc
+	closed bool
+}
+
+func NewManager(url string) *Manager {
+	return &Manager{url: url}
+}
+
+// Connect dials until the broker is reachable, or gives up after attempts
+// tries, and starts watching the connection.
+func (m *Manager) Connect(attempts int) error {
+	var err error
+	delay := minRedialDelay
+	for i := 0; i < attempts; i++ {
+		var conn *amqp.Connection
+		conn, err = amqp.Dial(m.url)
+		if err == nil {
+			log.Println("Connected to RabbitMQ")
+			m.mu.Lock()
+			m.conn = conn
+			m.mu.Unlock()
+			go m.watch(conn)
+			return nil
+		}
+		log.Printf("Failed to connect to RabbitMQ (attempt %d/%d): %v. Retrying in %s...", i+1, attempts, err, delay)
+		time.Sleep(delay)
+		delay = min(delay*2, maxRedialDelay)
+	}
+	return err
+}
+
+// OnConnect registers setup and runs it right away on the current
+// connection. A failure there is returned; failures after a reconnect are
+// logged and force another reconnect.
+func (m *Manager) OnConnect(setup SetupFunc) error {
+	m.mu.Lock()
+	m.setups = append(m.setups, setup)
+	conn := m.conn
+	m.mu.Unlock()
+	if conn == nil {
+		return ErrNotConnected
+	}
+	return setup(conn)
+}
+
+// Channel opens a channel on the current connection.
+func (m *Manager) Channel() (*amqp.Channel, error) {
+	m.mu.RLock()
+	conn := m.conn
+	m.mu.RUnlock()
+	if conn == nil || conn.IsClosed() {
+		return nil, ErrNotConnected
+	}
+	return conn.Channel()
+}
+
+// Connected reports whether the connection is currently open, for health
+// checks.
+func (m *Manager) Connected() bool {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	return m.conn != nil && !m.conn.IsClosed()
+}
+
+func (m *Manager) Close() error {
+	m.mu.Lock()
+	m.closed = true
+	conn := m.conn
+	m.mu.Unlock()
+	if conn == nil {
+		return nil
+	}
+	return conn.Close()
+}
+
+// watch waits for conn to close and replaces it with a new connection.
+func (m *Manager) watch(conn *amqp.Connection) {
+	for {
+		reason := <-conn.NotifyClose(make(chan *amqp.Error, 1))
+		m.mu.RLock()
+		closed := m.closed
+		m.mu.RUnlock()
+		if closed {
+			return
+		}
+		log.Printf("RabbitMQ connection lost: %v", reason)
+		conn = m.redial()
+		if conn == nil {
+			return
+		}
+	}
+}
+
+// Reopen runs open again on conn after the broker closed a channel that open
+// had set up while conn itself stayed up, retrying with backoff. If conn is
+// gone it does nothing, since the reconnect runs every SetupFunc anyway.
+func (m *Manager) Reopen(conn *amqp.Connection, name string, open SetupFunc) {
+	delay := minRedialDelay
+	for {
+		m.mu.RLock()
+		closed := m.closed
+		m.mu.RUnlock()
+		if closed || conn.IsClosed() {
+			return
+		}
+		err := open(conn)
+		if err == nil {
+			log.Printf("RabbitMQ %s reopened", name)
+			return
+		}
+		log.Printf("RabbitMQ %s reopen failed, retrying in %s: %v", name, delay, err)
+		time.Sleep(delay)
+		delay = min(delay*2, maxRedialDelay)
+	}
+}
+
+// redial dials with backoff until it gets a connection on which every setup
+// succeeds. It returns nil if the manager was closed meanwhile.
+func (m *Manager) redial() *amqp.Connection {
+	delay := minRedialDelay
+	for {
+		time.Sleep(delay)
+		delay = min(delay*2, maxRedialDelay)
+		m.mu.RLock()
+		closed := m.closed
+		m.mu.RUnlock()
+		if closed {
+			return nil
+		}
+		conn, err := amqp.Dial(m.url)
+		if err != nil {
+			log.Printf("RabbitMQ reconnect failed, retrying in %s: %v", delay, err)
+			continue
+		}
+		m.mu.Lock()
+		m.conn = conn
+		setups := append([]SetupFunc(nil), m.setups...)
+		m.mu.Unlock()
+		if err := runSetups(conn, setups); err != nil {
+			log.Printf("RabbitMQ setup after reconnect failed, retrying in %s: %v", delay, err)
+			conn.Close()
+			continue
+		}
+		log.Println("Reconnected to RabbitMQ")
+		return conn
+	}
+}
+
+func runSetups(conn *amqp.Connection, setups []SetupFunc) error {
+	for _, setup := range setups {
+		if err := setup(conn); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,3 @@
+// Package e2e runs the checkout saga of order-service, payment-service and
+// the gateway in one process, connected by broker.Memory instead of RabbitMQ.
+package e2e
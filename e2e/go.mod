@@ -0,0 +1,36 @@
+module e2e
+
+go 1.25.3
+
+require (
+	api-gateway v0.0.0
+	broker v0.0.0
+	github.com/gorilla/websocket v1.5.3
+	github.com/lib/pq v1.10.9
+	order-service v0.0.0
+	payment-service v0.0.0
+)
+
+require (
+	github.com/cespare/xxhash/v2 v2.3.0 // indirect
+	github.com/go-logr/logr v1.4.3 // indirect
+	github.com/go-logr/stdr v1.2.2 // indirect
+	github.com/google/uuid v1.6.0 // indirect
+	github.com/rabbitmq/amqp091-go v1.10.0 // indirect
+	go.opentelemetry.io/auto/sdk v1.2.1 // indirect
+	go.opentelemetry.io/otel v1.44.0 // indirect
+	go.opentelemetry.io/otel/exporters/stdout/stdouttrace v1.44.0 // indirect
+	go.opentelemetry.io/otel/metric v1.44.0 // indirect
+	go.opentelemetry.io/otel/sdk v1.44.0 // indirect
+	go.opentelemetry.io/otel/trace v1.44.0 // indirect
+	golang.org/x/sys v0.45.0 // indirect
+	shared v0.0.0 // indirect
+)
+
+replace (
+	api-gateway => ../api-gateway
+	broker => ../broker
+	order-service => ../order-service
+	payment-service => ../payment-service
+	shared => ../shared
+)
@@ -0,0 +1,174 @@
+package e2e
+
+import (
+	gateway "api-gateway/app"
+	"broker"
+	"bytes"
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	orders "order-service/app"
+	"os"
+	payments "payment-service/app"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+	_ "github.com/lib/pq"
+)
+
+// sagaTimeout bounds every asynchronous step of the saga.
+const sagaTimeout = 15 * time.Second
+
+// TestCheckoutSaga creates an order for a funded account and follows it
+// through the outbox of order-service, the payment inbox and outbox and the
+// order inbox, until the gateway pushes the payment result over WebSocket and
+// the order is finished. Only Postgres is needed, in GOZON_TEST_DB, e.g.
+// "host=localhost port=5435 user=user password=password dbname=gozon sslmode=disable"
+// with docker compose.
+func TestCheckoutSaga(t *testing.T) {
+	connStr := os.Getenv("GOZON_TEST_DB")
+	if connStr == "" {
+		t.Skip("GOZON_TEST_DB is not set")
+	}
+	db, err := sql.Open("postgres", connStr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	if err := orders.Migrate(db); err != nil {
+		t.Fatal(err)
+	}
+	if err := payments.Migrate(db); err != nil {
+		t.Fatal(err)
+	}
+
+	bus := broker.NewMemory()
+	defer bus.Close()
+	if err := gateway.StartListener(bus); err != nil {
+		t.Fatal(err)
+	}
+	// payment-service goes first, so orders_queue is bound before
+	// order-service publishes OrderCreated.
+	paymentAPI, err := payments.Start(db, connStr, bus, nil, payments.ConfigFromEnv())
+	if err != nil {
+		t.Fatal(err)
+	}
+	orderAPI, err := orders.Start(db, connStr, bus, nil, orders.ConfigFromEnv())
+	if err != nil {
+		t.Fatal(err)
+	}
+	paymentServer := httptest.NewServer(paymentAPI)
+	defer paymentServer.Close()
+	orderServer := httptest.NewServer(orderAPI)
+	defer orderServer.Close()
+	gatewayServer := httptest.NewServer(http.HandlerFunc(gateway.WSHandler))
+	defer gatewayServer.Close()
+
+	// A fresh user per run, since the database outlives the test.
+	userID := time.Now().UnixNano()%1_000_000_000 + 1_000_000_000
+	ws, _, err := websocket.DefaultDialer.Dial(fmt.Sprintf("ws%s/ws?user_id=%d", strings.TrimPrefix(gatewayServer.URL, "http"), userID), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ws.Close()
+
+	const deposit = 100000
+	call(t, http.MethodPost, paymentServer.URL+"/accounts", map[string]interface{}{"user_id": userID}, nil)
+	call(t, http.MethodPost, paymentServer.URL+"/accounts/deposit", map[string]interface{}{"user_id": userID, "amount": deposit}, nil)
+	var products []struct {
+		ID int64 `json:"id"`
+	}
+	call(t, http.MethodGet, orderServer.URL+"/products", nil, &products)
+	if len(products) == 0 {
+		t.Fatal("no products in the catalog")
+	}
+	var order struct {
+		ID     int64  `json:"id"`
+		Amount int64  `json:"amount"`
+		Status string `json:"status"`
+	}
+	call(t, http.MethodPost, orderServer.URL+"/orders", map[string]interface{}{
+		"user_id": userID,
+		"items":   []map[string]interface{}{{"product_id": products[0].ID, "quantity": 2}},
+	}, &order)
+	if order.Status != "new" {
+		t.Fatalf("new order has status %q", order.Status)
+	}
+
+	// The gateway pushes the payment result to the user.
+	ws.SetReadDeadline(time.Now().Add(sagaTimeout))
+	for {
+		_, msg, err := ws.ReadMessage()
+		if err != nil {
+			t.Fatalf("no payment result for order %d: %v", order.ID, err)
+		}
+		var event struct {
+			OrderID int64  `json:"order_id"`
+			Status  string `json:"status"`
+		}
+		if json.Unmarshal(msg, &event) != nil || event.OrderID != order.ID {
+			continue
+		}
+		if event.Status != "PaymentSucceeded" {
+			t.Fatalf("order %d got %s", order.ID, event.Status)
+		}
+		break
+	}
+
+	// order-service applies the same result independently of the gateway.
+	deadline := time.Now().Add(sagaTimeout)
+	for {
+		call(t, http.MethodGet, fmt.Sprintf("%s/orders/by-id?id=%d", orderServer.URL, order.ID), nil, &order)
+		if order.Status == "finished" {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("order %d is still %s", order.ID, order.Status)
+		}
+		time.Sleep(50 * time.Millisecond)
+	}
+
+	var balance struct {
+		Balance int64 `json:"balance"`
+	}
+	call(t, http.MethodGet, fmt.Sprintf("%s/accounts/balance?user_id=%d", paymentServer.URL, userID), nil, &balance)
+	if want := deposit - order.Amount; balance.Balance != want {
+		t.Fatalf("balance is %d after paying %d, want %d", balance.Balance, order.Amount, want)
+	}
+}
+
+// call sends body as JSON to url, fails the test on anything but 2xx and
+// decodes the response into out unless it is nil.
+func call(t *testing.T, method, url string, body, out interface{}) {
+	t.Helper()
+	var payload bytes.Buffer
+	if body != nil {
+		if err := json.NewEncoder(&payload).Encode(body); err != nil {
+			t.Fatal(err)
+		}
+	}
+	req, err := http.NewRequest(method, url, &payload)
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.Header.Set("Content-Type", "application/json")
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode/100 != 2 {
+		var msg bytes.Buffer
+		msg.ReadFrom(resp.Body)
+		t.Fatalf("%s %s: %s %s", method, url, resp.Status, strings.TrimSpace(msg.String()))
+	}
+	if out != nil {
+		if err := json.NewDecoder(resp.Body).Decode(out); err != nil {
+			t.Fatalf("%s %s: decode response: %v", method, url, err)
+		}
+	}
+}
@@ -0,0 +1,199 @@
+// Package app assembles order-service: its schema, background processors and
+// HTTP API. cmd/main.go runs it on Postgres and RabbitMQ; the end-to-end test
+// in e2e runs it on broker.Memory.
+package app
+
+import (
+	"broker"
+	"broker/deadletter"
+	"database/sql"
+	"expvar"
+	"fmt"
+	"log"
+	"net/http"
+	"order-service/internal/handler"
+	"order-service/internal/inbox"
+	"order-service/internal/outbox"
+	"order-service/internal/repository"
+	"order-service/internal/sweeper"
+	"os"
+	"shared/idempotency"
+	"shared/retention"
+	"strconv"
+	"time"
+
+	"github.com/lib/pq"
+)
+
+// Config holds the settings of the background processors.
+type Config struct {
+	Inbox     inbox.Config
+	Retention retention.Config
+	Sweeper   sweeper.Config
+}
+
+// ConfigFromEnv reads Config from the environment, falling back to the
+// defaults for unset variables.
+func ConfigFromEnv() Config {
+	return Config{
+		Inbox: inbox.Config{
+			MaxRetries: envInt("INBOX_MAX_RETRIES", 5),
+			RetryDelay: envDuration("INBOX_RETRY_DELAY", 5*time.Second),
+			Prefetch:   envInt("INBOX_PREFETCH", 32),
+			Workers:    envInt("INBOX_WORKERS", 8),
+		},
+		Retention: retention.Config{
+			MaxAge:    envDuration("OUTBOX_RETENTION", 7*24*time.Hour),
+			Archive:   os.Getenv("OUTBOX_RETENTION_MODE") != "delete",
+			Interval:  envDuration("OUTBOX_RETENTION_INTERVAL", 10*time.Minute),
+			BatchSize: 500,
+		},
+		Sweeper: sweeper.Config{
+			Deadline:   envDuration("ORDER_PAYMENT_DEADLINE", 30*time.Second),
+			MaxRetries: envInt("ORDER_PAYMENT_MAX_RETRIES", 3),
+			Interval:   envDuration("ORDER_SWEEP_INTERVAL", 10*time.Second),
+			BatchSize:  50,
+		},
+	}
+}
+
+// Start starts the outbox, the inbox and the background jobs of
+// order-service on db and bus and returns its HTTP API. connStr is used to
+// LISTEN for outbox notifications. parked opens the AMQP channels the admin
+// API browses parked messages on; with nil those endpoints are left out.
+func Start(db *sql.DB, connStr string, bus broker.Broker, parked deadletter.ChannelOpener, cfg Config) (http.Handler, error) {
+	listener := pq.NewListener(connStr, time.Second, time.Minute, nil)
+	if err := listener.Listen(outbox.NotifyChannel); err != nil {
+		return nil, fmt.Errorf("listen for outbox notifications: %w", err)
+	}
+	processor, err := outbox.NewOutboxProcessor(db, bus, listener)
+	if err != nil {
+		return nil, fmt.Errorf("init outbox processor: %w", err)
+	}
+	orderRepo := repository.NewOrderRepository(db)
+	orderHandler := handler.NewOrderHandler(orderRepo)
+	productRepo := repository.NewProductRepository(db)
+	productHandler := handler.NewProductHandler(productRepo)
+	adminHandler := handler.NewAdminHandler(
+		repository.NewOutboxRepository(db),
+		deadletter.NewParkingLot(parked, inbox.Queue),
+	)
+	healthHandler := handler.NewHealthHandler(bus.Connected)
+	idempotencyStore := idempotency.NewStore(db, "order_idempotency_keys", time.Minute)
+	createOrder := idempotencyStore.Middleware("POST /orders", orderHandler.CreateOrder)
+
+	processor.Start()
+	orderInbox, err := inbox.NewInboxProcessor(db, orderRepo, bus, cfg.Inbox)
+	if err != nil {
+		return nil, fmt.Errorf("init order inbox: %w", err)
+	}
+	if err := orderInbox.Start(); err != nil {
+		return nil, fmt.Errorf("start order inbox: %w", err)
+	}
+	retention.NewJob(db, retention.Table{Name: "outbox", Archive: "outbox_archive", TypeColumn: "event_type"}, cfg.Retention).Start()
+	sweeper.NewSweeper(orderRepo, cfg.Sweeper).Start()
+	mux := http.NewServeMux()
+	mux.HandleFunc("/orders", func(w http.ResponseWriter, r *http.Request) {
+		if r.Method == http.MethodPost {
+			createOrder(w, r)
+		} else if r.Method == http.MethodGet {
+			orderHandler.GetOrdersByUserID(w, r)
+		} else {
+			http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		}
+	})
+
+	mux.HandleFunc("/orders/by-id", func(w http.ResponseWriter, r *http.Request) {
+		if r.Method == http.MethodGet {
+			orderHandler.GetOrderByID(w, r)
+		} else {
+			http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		}
+	})
+	mux.HandleFunc("/orders/{id}/cancel", func(w http.ResponseWriter, r *http.Request) {
+		if r.Method == http.MethodPost {
+			orderHandler.CancelOrder(w, r)
+		} else {
+			http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		}
+	})
+	mux.HandleFunc("/orders/{id}/history", func(w http.ResponseWriter, r *http.Request) {
+		if r.Method == http.MethodGet {
+			orderHandler.GetStatusHistory(w, r)
+		} else {
+			http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		}
+	})
+	mux.HandleFunc("/products", func(w http.ResponseWriter, r *http.Request) {
+		if r.Method == http.MethodGet {
+			productHandler.ListProducts(w, r)
+		} else {
+			http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		}
+	})
+	mux.HandleFunc("/admin/outbox/failed", func(w http.ResponseWriter, r *http.Request) {
+		if r.Method == http.MethodGet {
+			adminHandler.ListFailedOutbox(w, r)
+		} else {
+			http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		}
+	})
+	mux.HandleFunc("/admin/outbox/{id}/requeue", func(w http.ResponseWriter, r *http.Request) {
+		if r.Method == http.MethodPost {
+			adminHandler.RequeueOutbox(w, r)
+		} else {
+			http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		}
+	})
+	// Parked messages are browsed over AMQP, so there is nothing to show
+	// without RabbitMQ.
+	if parked != nil {
+		mux.HandleFunc("/admin/parked", func(w http.ResponseWriter, r *http.Request) {
+			if r.Method == http.MethodGet {
+				adminHandler.ListParked(w, r)
+			} else {
+				http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+			}
+		})
+		mux.HandleFunc("/admin/parked/{id}/replay", func(w http.ResponseWriter, r *http.Request) {
+			if r.Method == http.MethodPost {
+				adminHandler.ReplayParked(w, r)
+			} else {
+				http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+			}
+		})
+	}
+	mux.HandleFunc("/health", func(w http.ResponseWriter, r *http.Request) {
+		if r.Method == http.MethodGet {
+			healthHandler.Check(w, r)
+		} else {
+			http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		}
+	})
+	mux.Handle("/debug/vars", expvar.Handler())
+	return mux, nil
+}
+
+func envDuration(name string, def time.Duration) time.Duration {
+	v := os.Getenv(name)
+	if v == "" {
+		return def
+	}
+	d, err := time.ParseDuration(v)
+	if err != nil {
+		log.Fatalf("invalid %s: %v", name, err)
+	}
+	return d
+}
+
+func envInt(name string, def int) int {
+	v := os.Getenv(name)
+	if v == "" {
+		return def
+	}
+	n, err := strconv.Atoi(v)
+	if err != nil {
+		log.Fatalf("invalid %s: %v", name, err)
+	}
+	return n
+}
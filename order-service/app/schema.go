@@ -0,0 +1,129 @@
+package app
+
+import (
+	"database/sql"
+	"fmt"
+	"log"
+)
+
+// Migrate creates or upgrades the tables, indexes and triggers order-service
+// needs. Every statement is idempotent, so it runs on every start.
+func Migrate(db *sql.DB) error {
+	query := `
+    CREATE TABLE IF NOT EXISTS orders (
+        id SERIAL PRIMARY KEY,
+        user_id BIGINT NOT NULL,
+        amount BIGINT NOT NULL,
+        status VARCHAR(50) NOT NULL DEFAULT 'new',
+        created_at TIMESTAMP NOT NULL DEFAULT NOW()
+    );
+    ALTER TABLE orders ADD COLUMN IF NOT EXISTS payment_requested_at TIMESTAMP NOT NULL DEFAULT NOW();
+    ALTER TABLE orders ADD COLUMN IF NOT EXISTS payment_retries INT NOT NULL DEFAULT 0;
+    ALTER TABLE orders ADD COLUMN IF NOT EXISTS correlation_id VARCHAR(36);
+    CREATE INDEX IF NOT EXISTS idx_orders_new_payment_requested ON orders (payment_requested_at) WHERE status = 'new';
+    CREATE INDEX IF NOT EXISTS idx_orders_user_created ON orders (user_id, created_at DESC, id DESC);
+    CREATE TABLE IF NOT EXISTS order_status_history (
+        id SERIAL PRIMARY KEY,
+        order_id BIGINT NOT NULL REFERENCES orders(id),
+        from_status VARCHAR(50),
+        to_status VARCHAR(50) NOT NULL,
+        cause VARCHAR(50) NOT NULL,
+        event_id VARCHAR(255),
+        created_at TIMESTAMP NOT NULL DEFAULT NOW()
+    );
+    CREATE INDEX IF NOT EXISTS idx_order_status_history_order_id ON order_status_history (order_id);
+    CREATE TABLE IF NOT EXISTS order_inbox_messages (
+        id SERIAL PRIMARY KEY,
+        message_id VARCHAR(255) NOT NULL UNIQUE,
+        type VARCHAR(100) NOT NULL,
+        order_id BIGINT NOT NULL,
+        payload JSONB NOT NULL,
+        outcome VARCHAR(20),
+        created_at TIMESTAMP NOT NULL DEFAULT NOW()
+    );
+    CREATE INDEX IF NOT EXISTS idx_order_inbox_messages_order_id ON order_inbox_messages (order_id);
+    CREATE TABLE IF NOT EXISTS products (
+        id SERIAL PRIMARY KEY,
+        name VARCHAR(255) NOT NULL,
+        price BIGINT NOT NULL CHECK (price > 0),
+        created_at TIMESTAMP NOT NULL DEFAULT NOW()
+    );
+    CREATE TABLE IF NOT EXISTS order_items (
+        id SERIAL PRIMARY KEY,
+        order_id BIGINT NOT NULL REFERENCES orders(id),
+        product_id BIGINT NOT NULL REFERENCES products(id),
+        quantity BIGINT NOT NULL CHECK (quantity > 0),
+        unit_price BIGINT NOT NULL
+    );
+    CREATE INDEX IF NOT EXISTS idx_order_items_order_id ON order_items (order_id);
+    INSERT INTO products (name, price)
+    SELECT name, price FROM (VALUES
+        ('Keyboard', 150),
+        ('Mouse', 50),
+        ('Monitor', 900),
+        ('Headphones', 200)
+    ) AS seed(name, price)
+    WHERE NOT EXISTS (SELECT 1 FROM products);
+    CREATE TABLE IF NOT EXISTS order_idempotency_keys (
+        key VARCHAR(255) NOT NULL,
+        scope VARCHAR(100) NOT NULL,
+        fingerprint VARCHAR(64) NOT NULL,
+        status VARCHAR(20) NOT NULL DEFAULT 'processing',
+        response_code INT,
+        response_body BYTEA,
+        response_content_type VARCHAR(100),
+        locked_at TIMESTAMP NOT NULL DEFAULT NOW(),
+        created_at TIMESTAMP NOT NULL DEFAULT NOW(),
+        completed_at TIMESTAMP,
+        PRIMARY KEY (key, scope)
+    );
+    CREATE TABLE IF NOT EXISTS outbox (
+        id SERIAL PRIMARY KEY,
+        event_type VARCHAR(50) NOT NULL,
+        payload JSONB NOT NULL,
+        status VARCHAR(20) NOT NULL DEFAULT 'new',
+        attempts INT NOT NULL DEFAULT 0,
+        last_error TEXT,
+        next_attempt_at TIMESTAMP NOT NULL DEFAULT NOW(),
+        created_at TIMESTAMP NOT NULL DEFAULT NOW(),
+        processed_at TIMESTAMP
+    );
+    ALTER TABLE outbox ADD COLUMN IF NOT EXISTS processed_at TIMESTAMP;
+    ALTER TABLE outbox ADD COLUMN IF NOT EXISTS attempts INT NOT NULL DEFAULT 0;
+    ALTER TABLE outbox ADD COLUMN IF NOT EXISTS last_error TEXT;
+    ALTER TABLE outbox ADD COLUMN IF NOT EXISTS next_attempt_at TIMESTAMP NOT NULL DEFAULT NOW();
+    ALTER TABLE outbox ADD COLUMN IF NOT EXISTS event_id VARCHAR(36);
+    ALTER TABLE outbox ADD COLUMN IF NOT EXISTS trace_context JSONB;
+    CREATE INDEX IF NOT EXISTS idx_outbox_due ON outbox (next_attempt_at) WHERE status = 'new';
+    CREATE INDEX IF NOT EXISTS idx_outbox_event_id ON outbox (event_id);
+    CREATE TABLE IF NOT EXISTS outbox_archive (
+        id BIGINT NOT NULL,
+        event_id VARCHAR(36),
+        trace_context JSONB,
+        event_type VARCHAR(50) NOT NULL,
+        payload JSONB NOT NULL,
+        status VARCHAR(20) NOT NULL,
+        attempts INT NOT NULL DEFAULT 0,
+        last_error TEXT,
+        created_at TIMESTAMP NOT NULL,
+        processed_at TIMESTAMP,
+        archived_at TIMESTAMP NOT NULL DEFAULT NOW()
+    ) PARTITION BY RANGE (archived_at);
+    ALTER TABLE outbox_archive ADD COLUMN IF NOT EXISTS event_id VARCHAR(36);
+    ALTER TABLE outbox_archive ADD COLUMN IF NOT EXISTS trace_context JSONB;
+    CREATE OR REPLACE FUNCTION notify_outbox_new() RETURNS trigger AS $$
+    BEGIN
+        PERFORM pg_notify('outbox_new', '');
+        RETURN NULL;
+    END;
+    $$ LANGUAGE plpgsql;
+    CREATE OR REPLACE TRIGGER outbox_notify_new
+        AFTER INSERT ON outbox
+        FOR EACH STATEMENT EXECUTE FUNCTION notify_outbox_new();`
+	_, err := db.Exec(query)
+	if err != nil {
+		return fmt.Errorf("failed to create tables: %w", err)
+	}
+	log.Println("Tables created!")
+	return nil
+}
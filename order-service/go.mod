@@ -3,6 +3,27 @@ module order-service
 go 1.25.3
 
 require (
+	broker v0.0.0
 	github.com/lib/pq v1.10.9
-	github.com/rabbitmq/amqp091-go v1.10.0
+	go.opentelemetry.io/otel/trace v1.44.0
+	shared v0.0.0
+)
+
+require (
+	github.com/cespare/xxhash/v2 v2.3.0 // indirect
+	github.com/go-logr/logr v1.4.3 // indirect
+	github.com/go-logr/stdr v1.2.2 // indirect
+	github.com/google/uuid v1.6.0 // indirect
+	github.com/rabbitmq/amqp091-go v1.10.0 // indirect
+	go.opentelemetry.io/auto/sdk v1.2.1 // indirect
+	go.opentelemetry.io/otel v1.44.0 // indirect
+	go.opentelemetry.io/otel/exporters/stdout/stdouttrace v1.44.0 // indirect
+	go.opentelemetry.io/otel/metric v1.44.0 // indirect
+	go.opentelemetry.io/otel/sdk v1.44.0 // indirect
+	golang.org/x/sys v0.45.0 // indirect
+)
+
+replace (
+	broker => ../broker
+	shared => ../shared
 )
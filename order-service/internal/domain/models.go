@@ -1,6 +1,9 @@
 package domain
 
-import "time"
+import (
+	"encoding/json"
+	"time"
+)
 
 type OrderStatus string
 
@@ -8,6 +11,22 @@ const (
 	OrderStatusNew       OrderStatus = "new"
 	OrderStatusFinished  OrderStatus = "finished"
 	OrderStatusCancelled OrderStatus = "cancelled"
+	OrderStatusRefunded  OrderStatus = "refunded"
+)
+
+// Valid reports whether s is one of the statuses above.
+func (s OrderStatus) Valid() bool {
+	switch s {
+	case OrderStatusNew, OrderStatusFinished, OrderStatusCancelled, OrderStatusRefunded:
+		return true
+	}
+	return false
+}
+
+// Reasons carried by OrderCancelled events.
+const (
+	CancelReasonCustomer = "customer"
+	CancelReasonTimeout  = "timeout"
 )
 
 type Order struct {
@@ -15,5 +34,33 @@ type Order struct {
 	UserID    int64       `json:"user_id"`
 	Amount    int64       `json:"amount"`
 	Status    OrderStatus `json:"status"`
+	Items     []OrderItem `json:"items"`
 	CreatedAt time.Time   `json:"created_at"`
 }
+
+// MaxItemQuantity caps the quantity of one order item.
+const MaxItemQuantity = 1000
+
+type OrderItem struct {
+	ProductID int64 `json:"product_id"`
+	Quantity  int64 `json:"quantity"`
+	UnitPrice int64 `json:"unit_price"`
+}
+
+type Product struct {
+	ID        int64     `json:"id"`
+	Name      string    `json:"name"`
+	Price     int64     `json:"price"`
+	CreatedAt time.Time `json:"created_at"`
+}
+
+type OutboxEvent struct {
+	ID            int64           `json:"id"`
+	EventType     string          `json:"event_type"`
+	Payload       json.RawMessage `json:"payload"`
+	Status        string          `json:"status"`
+	Attempts      int             `json:"attempts"`
+	LastError     *string         `json:"last_error"`
+	NextAttemptAt time.Time       `json:"next_attempt_at"`
+	CreatedAt     time.Time       `json:"created_at"`
+}
@@ -0,0 +1,79 @@
+package domain
+
+import (
+	"errors"
+	"fmt"
+	"time"
+)
+
+var ErrIllegalTransition = errors.New("illegal order status transition")
+
+// OrderEvent is whatever caused an order to change its status: a payment
+// result from payment-service or an action taken by the customer.
+type OrderEvent string
+
+const (
+	OrderEventCreated          OrderEvent = "OrderCreated"
+	OrderEventCancelRequested  OrderEvent = "CancelRequested"
+	OrderEventPaymentTimedOut  OrderEvent = "PaymentTimedOut"
+	OrderEventPaymentSucceeded OrderEvent = "PaymentSucceeded"
+	OrderEventPaymentFailed    OrderEvent = "PaymentFailed"
+	OrderEventPaymentRefunded  OrderEvent = "PaymentRefunded"
+	OrderEventPaymentExpired   OrderEvent = "PaymentExpired"
+)
+
+type Transition struct {
+	From  OrderStatus
+	Event OrderEvent
+	To    OrderStatus
+}
+
+// OrderStateMachine holds the legal order status transitions. Anything not
+// declared is rejected, so a late or duplicated event can not move an order
+// out of a state it has already left.
+type OrderStateMachine struct {
+	transitions map[OrderStatus]map[OrderEvent]OrderStatus
+}
+
+func NewOrderStateMachine(transitions []Transition) *OrderStateMachine {
+	m := &OrderStateMachine{transitions: make(map[OrderStatus]map[OrderEvent]OrderStatus)}
+	for _, t := range transitions {
+		if m.transitions[t.From] == nil {
+			m.transitions[t.From] = make(map[OrderEvent]OrderStatus)
+		}
+		m.transitions[t.From][t.Event] = t.To
+	}
+	return m
+}
+
+// OrderLifecycle is the state machine every order goes through.
+var OrderLifecycle = NewOrderStateMachine([]Transition{
+	{From: OrderStatusNew, Event: OrderEventPaymentSucceeded, To: OrderStatusFinished},
+	{From: OrderStatusNew, Event: OrderEventPaymentFailed, To: OrderStatusCancelled},
+	{From: OrderStatusNew, Event: OrderEventCancelRequested, To: OrderStatusCancelled},
+	{From: OrderStatusNew, Event: OrderEventPaymentTimedOut, To: OrderStatusCancelled},
+	{From: OrderStatusFinished, Event: OrderEventCancelRequested, To: OrderStatusCancelled},
+	// In manual capture mode an order is finished once its hold is taken and
+	// cancelled if the hold expires before it is captured.
+	{From: OrderStatusFinished, Event: OrderEventPaymentExpired, To: OrderStatusCancelled},
+	{From: OrderStatusCancelled, Event: OrderEventPaymentRefunded, To: OrderStatusRefunded},
+})
+
+// Next returns the status an order in from moves to when event happens.
+func (m *OrderStateMachine) Next(from OrderStatus, event OrderEvent) (OrderStatus, error) {
+	to, ok := m.transitions[from][event]
+	if !ok {
+		return "", fmt.Errorf("%w: %s on %s order", ErrIllegalTransition, event, from)
+	}
+	return to, nil
+}
+
+type OrderStatusChange struct {
+	ID         int64        `json:"id"`
+	OrderID    int64        `json:"order_id"`
+	FromStatus *OrderStatus `json:"from_status"`
+	ToStatus   OrderStatus  `json:"to_status"`
+	Cause      OrderEvent   `json:"cause"`
+	EventID    *string      `json:"event_id,omitempty"`
+	CreatedAt  time.Time    `json:"created_at"`
+}
@@ -0,0 +1,90 @@
+package domain
+
+import (
+	"errors"
+	"testing"
+)
+
+func TestOrderLifecycle(t *testing.T) {
+	tests := []struct {
+		from  OrderStatus
+		event OrderEvent
+		to    OrderStatus // empty if the transition is illegal
+	}{
+		{OrderStatusNew, OrderEventPaymentSucceeded, OrderStatusFinished},
+		{OrderStatusNew, OrderEventPaymentFailed, OrderStatusCancelled},
+		{OrderStatusNew, OrderEventCancelRequested, OrderStatusCancelled},
+		{OrderStatusNew, OrderEventPaymentTimedOut, OrderStatusCancelled},
+		{OrderStatusFinished, OrderEventCancelRequested, OrderStatusCancelled},
+		{OrderStatusFinished, OrderEventPaymentExpired, OrderStatusCancelled},
+		{OrderStatusCancelled, OrderEventPaymentRefunded, OrderStatusRefunded},
+
+		// A late or duplicated payment result must not move a settled order.
+		{OrderStatusFinished, OrderEventPaymentFailed, ""},
+		{OrderStatusFinished, OrderEventPaymentSucceeded, ""},
+		{OrderStatusFinished, OrderEventPaymentTimedOut, ""},
+		{OrderStatusCancelled, OrderEventPaymentSucceeded, ""},
+		{OrderStatusCancelled, OrderEventCancelRequested, ""},
+		{OrderStatusRefunded, OrderEventPaymentRefunded, ""},
+		{OrderStatusRefunded, OrderEventCancelRequested, ""},
+		// Nothing was charged for a new order, so there is nothing to refund
+		// and no hold to expire.
+		{OrderStatusNew, OrderEventPaymentRefunded, ""},
+		{OrderStatusNew, OrderEventPaymentExpired, ""},
+		{OrderStatusNew, OrderEventCreated, ""},
+	}
+	for _, tt := range tests {
+		to, err := OrderLifecycle.Next(tt.from, tt.event)
+		if tt.to == "" {
+			if !errors.Is(err, ErrIllegalTransition) {
+				t.Errorf("%s on %s: got %q, %v, want ErrIllegalTransition", tt.event, tt.from, to, err)
+			}
+			continue
+		}
+		if err != nil || to != tt.to {
+			t.Errorf("%s on %s: got %q, %v, want %q", tt.event, tt.from, to, err, tt.to)
+		}
+	}
+}
+
+// TestOrderLifecycleRejectsUndeclared checks that every pair outside the
+// declared transitions is rejected, not just the ones listed above.
+func TestOrderLifecycleRejectsUndeclared(t *testing.T) {
+	legal := map[OrderStatus]map[OrderEvent]bool{
+		OrderStatusNew: {
+			OrderEventPaymentSucceeded: true,
+			OrderEventPaymentFailed:    true,
+			OrderEventCancelRequested:  true,
+			OrderEventPaymentTimedOut:  true,
+		},
+		OrderStatusFinished: {
+			OrderEventCancelRequested: true,
+			OrderEventPaymentExpired:  true,
+		},
+		OrderStatusCancelled: {
+			OrderEventPaymentRefunded: true,
+		},
+	}
+	statuses := []OrderStatus{OrderStatusNew, OrderStatusFinished, OrderStatusCancelled, OrderStatusRefunded}
+	events := []OrderEvent{
+		OrderEventCreated,
+		OrderEventCancelRequested,
+		OrderEventPaymentTimedOut,
+		OrderEventPaymentSucceeded,
+		OrderEventPaymentFailed,
+		OrderEventPaymentRefunded,
+		OrderEventPaymentExpired,
+	}
+	for _, from := range statuses {
+		for _, event := range events {
+			_, err := OrderLifecycle.Next(from, event)
+			if legal[from][event] {
+				if err != nil {
+					t.Errorf("%s on %s: %v", event, from, err)
+				}
+			} else if !errors.Is(err, ErrIllegalTransition) {
+				t.Errorf("%s on %s: got %v, want ErrIllegalTransition", event, from, err)
+			}
+		}
+	}
+}
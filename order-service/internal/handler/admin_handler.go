@@ -0,0 +1,103 @@
+package handler
+
+import (
+	"broker/deadletter"
+	"encoding/json"
+	"errors"
+	"io"
+	"net/http"
+	"order-service/internal/repository"
+	"strconv"
+)
+
+type AdminHandler struct {
+	outboxRepo *repository.OutboxRepository
+	parkingLot *deadletter.ParkingLot
+}
+
+func NewAdminHandler(outboxRepo *repository.OutboxRepository, parkingLot *deadletter.ParkingLot) *AdminHandler {
+	return &AdminHandler{outboxRepo: outboxRepo, parkingLot: parkingLot}
+}
+
+func (h *AdminHandler) ListFailedOutbox(w http.ResponseWriter, r *http.Request) {
+	limit, ok := limitParam(w, r)
+	if !ok {
+		return
+	}
+	events, err := h.outboxRepo.ListFailed(limit)
+	if err != nil {
+		http.Error(w, "failed to list outbox events: "+err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	_ = json.NewEncoder(w).Encode(events)
+}
+
+func (h *AdminHandler) RequeueOutbox(w http.ResponseWriter, r *http.Request) {
+	id, err := strconv.ParseInt(r.PathValue("id"), 10, 64)
+	if err != nil {
+		http.Error(w, "invalid id parameter", http.StatusBadRequest)
+		return
+	}
+	if err := h.outboxRepo.Requeue(id); err != nil {
+		if errors.Is(err, repository.ErrOutboxEventNotFound) {
+			http.Error(w, err.Error(), http.StatusNotFound)
+			return
+		}
+		http.Error(w, "failed to requeue outbox event: "+err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func (h *AdminHandler) ListParked(w http.ResponseWriter, r *http.Request) {
+	limit, ok := limitParam(w, r)
+	if !ok {
+		return
+	}
+	parked, err := h.parkingLot.List(limit)
+	if err != nil {
+		http.Error(w, "failed to list parked messages: "+err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	_ = json.NewEncoder(w).Encode(parked)
+}
+
+// ReplayParked sends a parked message back to its queue. A non-empty request
+// body replaces the message body, which is how a poison message is fixed.
+func (h *AdminHandler) ReplayParked(w http.ResponseWriter, r *http.Request) {
+	body, err := io.ReadAll(r.Body)
+	if err != nil {
+		http.Error(w, "invalid request body", http.StatusBadRequest)
+		return
+	}
+	if len(body) == 0 {
+		body = nil
+	} else if !json.Valid(body) {
+		http.Error(w, "request body must be valid JSON", http.StatusBadRequest)
+		return
+	}
+	if err := h.parkingLot.Replay(r.PathValue("id"), body); err != nil {
+		if errors.Is(err, deadletter.ErrParkedMessageNotFound) {
+			http.Error(w, err.Error(), http.StatusNotFound)
+			return
+		}
+		http.Error(w, "failed to replay parked message: "+err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func limitParam(w http.ResponseWriter, r *http.Request) (int, bool) {
+	limit := 100
+	if v := r.URL.Query().Get("limit"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n <= 0 {
+			http.Error(w, "invalid limit parameter", http.StatusBadRequest)
+			return 0, false
+		}
+		limit = n
+	}
+	return limit, true
+}
@@ -0,0 +1,28 @@
+package handler
+
+import (
+	"encoding/json"
+	"net/http"
+)
+
+type HealthHandler struct {
+	rabbitConnected func() bool
+}
+
+func NewHealthHandler(rabbitConnected func() bool) *HealthHandler {
+	return &HealthHandler{rabbitConnected: rabbitConnected}
+}
+
+// Check answers 503 while the RabbitMQ connection is down, so the instance
+// can be taken out of rotation until it has reconnected.
+func (h *HealthHandler) Check(w http.ResponseWriter, r *http.Request) {
+	status := map[string]string{"status": "ok", "rabbitmq": "connected"}
+	code := http.StatusOK
+	if !h.rabbitConnected() {
+		status = map[string]string{"status": "degraded", "rabbitmq": "disconnected"}
+		code = http.StatusServiceUnavailable
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(code)
+	_ = json.NewEncoder(w).Encode(status)
+}
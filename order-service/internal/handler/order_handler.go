@@ -2,10 +2,15 @@ package handler
 
 import (
 	"encoding/json"
+	"errors"
+	"fmt"
 	"net/http"
+	"net/url"
 	"order-service/internal/domain"
 	"order-service/internal/repository"
 	"strconv"
+	"strings"
+	"time"
 )
 
 type OrderHandler struct {
@@ -19,21 +24,40 @@ func NewOrderHandler(repo *repository.OrderRepository) *OrderHandler {
 func (h *OrderHandler) CreateOrder(w http.ResponseWriter, r *http.Request) {
 	var req struct {
 		UserID int64 `json:"user_id"`
-		Amount int64 `json:"amount"`
+		Items  []struct {
+			ProductID int64 `json:"product_id"`
+			Quantity  int64 `json:"quantity"`
+		} `json:"items"`
 	}
 	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
 		http.Error(w, "Invalid request body", http.StatusBadRequest)
 		return
 	}
-	if req.Amount <= 0 {
-		http.Error(w, "Amount can not be negative", http.StatusBadRequest)
+	if len(req.Items) == 0 {
+		http.Error(w, "Order must contain at least one item", http.StatusBadRequest)
+		return
 	}
 	order := &domain.Order{
 		UserID: req.UserID,
-		Amount: req.Amount,
+		Items:  make([]domain.OrderItem, 0, len(req.Items)),
+	}
+	for _, item := range req.Items {
+		if item.Quantity <= 0 || item.Quantity > domain.MaxItemQuantity {
+			http.Error(w, fmt.Sprintf("Quantity must be between 1 and %d", domain.MaxItemQuantity), http.StatusBadRequest)
+			return
+		}
+		order.Items = append(order.Items, domain.OrderItem{
+			ProductID: item.ProductID,
+			Quantity:  item.Quantity,
+		})
 	}
-	err := h.repo.CreateOrderWithOutbox(order)
+	err := h.repo.CreateOrderWithOutbox(r.Context(), order)
 	if err != nil {
+		if errors.Is(err, repository.ErrProductNotFound) || errors.Is(err, repository.ErrEmptyOrder) ||
+			errors.Is(err, repository.ErrInvalidQuantity) || errors.Is(err, repository.ErrAmountTooLarge) {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
 		http.Error(w, "Failed to create order: "+err.Error(), http.StatusInternalServerError)
 		return
 	}
@@ -63,7 +87,8 @@ func (h *OrderHandler) GetOrderByID(w http.ResponseWriter, r *http.Request) {
 }
 
 func (h *OrderHandler) GetOrdersByUserID(w http.ResponseWriter, r *http.Request) {
-	userIDStr := r.URL.Query().Get("user_id")
+	query := r.URL.Query()
+	userIDStr := query.Get("user_id")
 	if userIDStr == "" {
 		http.Error(w, "missing user_id parameter", http.StatusBadRequest)
 		return
@@ -73,11 +98,118 @@ func (h *OrderHandler) GetOrdersByUserID(w http.ResponseWriter, r *http.Request)
 		http.Error(w, "invalid user_id parameter", http.StatusBadRequest)
 		return
 	}
-	orders, err := h.repo.GetOrdersByUserID(userID)
+	filter := repository.OrderFilter{UserID: userID}
+	if v := query.Get("limit"); v != "" {
+		filter.Limit, err = strconv.Atoi(v)
+		if err != nil || filter.Limit <= 0 || filter.Limit > repository.MaxOrdersPageSize {
+			http.Error(w, fmt.Sprintf("limit must be between 1 and %d", repository.MaxOrdersPageSize), http.StatusBadRequest)
+			return
+		}
+	}
+	if v := query.Get("cursor"); v != "" {
+		filter.After, err = repository.DecodeOrderCursor(v)
+		if err != nil {
+			http.Error(w, "invalid cursor parameter", http.StatusBadRequest)
+			return
+		}
+	}
+	for _, v := range query["status"] {
+		for _, s := range strings.Split(v, ",") {
+			status := domain.OrderStatus(strings.TrimSpace(s))
+			if !status.Valid() {
+				http.Error(w, fmt.Sprintf("invalid status parameter: %q", status), http.StatusBadRequest)
+				return
+			}
+			filter.Statuses = append(filter.Statuses, status)
+		}
+	}
+	if filter.CreatedFrom, err = parseTimeParam(query, "created_from"); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if filter.CreatedTo, err = parseTimeParam(query, "created_to"); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if filter.MinAmount, err = parseInt64Param(query, "min_amount"); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if filter.MaxAmount, err = parseInt64Param(query, "max_amount"); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	page, err := h.repo.ListOrders(filter)
 	if err != nil {
 		http.Error(w, "failed to get orders: "+err.Error(), http.StatusInternalServerError)
 		return
 	}
 	w.Header().Set("Content-Type", "application/json")
-	_ = json.NewEncoder(w).Encode(orders)
+	_ = json.NewEncoder(w).Encode(page)
+}
+
+func parseTimeParam(query url.Values, name string) (*time.Time, error) {
+	v := query.Get(name)
+	if v == "" {
+		return nil, nil
+	}
+	t, err := time.Parse(time.RFC3339, v)
+	if err != nil {
+		return nil, fmt.Errorf("invalid %s parameter: expected RFC 3339 timestamp", name)
+	}
+	return &t, nil
+}
+
+func parseInt64Param(query url.Values, name string) (*int64, error) {
+	v := query.Get(name)
+	if v == "" {
+		return nil, nil
+	}
+	n, err := strconv.ParseInt(v, 10, 64)
+	if err != nil {
+		return nil, fmt.Errorf("invalid %s parameter", name)
+	}
+	return &n, nil
+}
+
+func (h *OrderHandler) CancelOrder(w http.ResponseWriter, r *http.Request) {
+	orderID, err := strconv.ParseInt(r.PathValue("id"), 10, 64)
+	if err != nil {
+		http.Error(w, "invalid id parameter", http.StatusBadRequest)
+		return
+	}
+	order, err := h.repo.CancelOrder(r.Context(), orderID)
+	if err != nil {
+		if errors.Is(err, repository.ErrOrderNotFound) {
+			http.Error(w, "order not found", http.StatusNotFound)
+			return
+		}
+		if errors.Is(err, domain.ErrIllegalTransition) {
+			http.Error(w, err.Error(), http.StatusConflict)
+			return
+		}
+		http.Error(w, "failed to cancel order: "+err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	_ = json.NewEncoder(w).Encode(order)
+}
+
+func (h *OrderHandler) GetStatusHistory(w http.ResponseWriter, r *http.Request) {
+	orderID, err := strconv.ParseInt(r.PathValue("id"), 10, 64)
+	if err != nil {
+		http.Error(w, "invalid id parameter", http.StatusBadRequest)
+		return
+	}
+	history, err := h.repo.GetStatusHistory(orderID)
+	if err != nil {
+		if errors.Is(err, repository.ErrOrderNotFound) {
+			http.Error(w, "order not found", http.StatusNotFound)
+			return
+		}
+		http.Error(w, "failed to get order history: "+err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	_ = json.NewEncoder(w).Encode(history)
 }
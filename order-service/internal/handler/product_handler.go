@@ -0,0 +1,25 @@
+package handler
+
+import (
+	"encoding/json"
+	"net/http"
+	"order-service/internal/repository"
+)
+
+type ProductHandler struct {
+	repo *repository.ProductRepository
+}
+
+func NewProductHandler(repo *repository.ProductRepository) *ProductHandler {
+	return &ProductHandler{repo: repo}
+}
+
+func (h *ProductHandler) ListProducts(w http.ResponseWriter, r *http.Request) {
+	products, err := h.repo.ListProducts()
+	if err != nil {
+		http.Error(w, "failed to get products: "+err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	_ = json.NewEncoder(w).Encode(products)
+}
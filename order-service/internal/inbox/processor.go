@@ -1,99 +1,137 @@
 package inbox
 
 import (
+	"broker"
+	"broker/deadletter"
+	"context"
 	"database/sql"
-	"encoding/json"
+	"errors"
+	"fmt"
 	"log"
 	"order-service/internal/domain"
+	"order-service/internal/repository"
+	"shared/events"
+	"shared/tracing"
+	"slices"
+	"time"
 
-	amqp "github.com/rabbitmq/amqp091-go"
+	"go.opentelemetry.io/otel/trace"
 )
 
+// Queue is the queue the processor consumes payment results from.
+const Queue = "payments_results_queue"
+
+type Config struct {
+	// MaxRetries and RetryDelay control how deliveries that fail with a
+	// transient error are retried before being parked.
+	MaxRetries int
+	RetryDelay time.Duration
+	// Prefetch is how many unacked deliveries the broker hands out at once.
+	Prefetch int
+	// Workers is how many deliveries are processed concurrently. Deliveries
+	// are sharded by user_id, so results for one order are still applied in
+	// the order they arrived.
+	Workers int
+}
+
+// handledEvents are the payment results the queue is bound to.
+var handledEvents = []domain.OrderEvent{
+	domain.OrderEventPaymentSucceeded,
+	domain.OrderEventPaymentFailed,
+	domain.OrderEventPaymentRefunded,
+	domain.OrderEventPaymentExpired,
+}
+
 type InboxProcessor struct {
-	db       *sql.DB
-	rabbitCh *amqp.Channel
+	db          *sql.DB
+	repo        *repository.OrderRepository
+	broker      broker.Broker
+	cfg         Config
+	deadLetters *deadletter.Handler
 }
 
-func NewInboxProcessor(db *sql.DB, conn *amqp.Connection) (*InboxProcessor, error) {
-	ch, err := conn.Channel()
-	if err != nil {
+// NewInboxProcessor declares the payment results queue together with its
+// dead-letter topology on b and creates a processor for it.
+func NewInboxProcessor(db *sql.DB, repo *repository.OrderRepository, b broker.Broker, cfg Config) (*InboxProcessor, error) {
+	if err := b.Declare(deadletter.Topology(Queue)); err != nil {
 		return nil, err
 	}
-	err = ch.ExchangeDeclare("payment_events_fanout", "fanout", true, false, false, false, nil)
-	if err != nil {
-		return nil, err
+	topology := broker.Topology{
+		Exchanges: []broker.Exchange{{Name: "payment_events", Kind: broker.Topic}},
+		Queues:    []broker.Queue{{Name: Queue, DeadLetter: deadletter.DeadLetterTarget(Queue)}},
 	}
-
-	q, err := ch.QueueDeclare("payments_results_queue", true, false, false, false, nil)
-	if err != nil {
-		return nil, err
+	for _, event := range handledEvents {
+		topology.Bindings = append(topology.Bindings, broker.Binding{
+			Queue:      Queue,
+			Exchange:   "payment_events",
+			RoutingKey: events.RoutingKey(string(event)),
+		})
 	}
-
-	err = ch.QueueBind(
-		q.Name,
-		"",
-		"payment_events_fanout",
-		false,
-		nil,
-	)
+	err := b.Declare(topology)
 	if err != nil {
 		return nil, err
 	}
-	return &InboxProcessor{db: db, rabbitCh: ch}, nil
+	return &InboxProcessor{
+		db:          db,
+		repo:        repo,
+		broker:      b,
+		cfg:         cfg,
+		deadLetters: deadletter.NewHandler(b, Queue, cfg.MaxRetries, cfg.RetryDelay),
+	}, nil
 }
 
+// Start starts consuming the payment results queue.
 func (processor *InboxProcessor) Start() error {
-	messages, err := processor.rabbitCh.Consume(
-		"payments_results_queue",
-		"",
-		false,
-		false,
-		false,
-		false,
-		nil,
-	)
+	pool := newShardedPool(processor.cfg.Workers, processor.processMessage)
+	return processor.broker.Subscribe(Queue, processor.cfg.Prefetch, func(message broker.Delivery) {
+		pool.dispatch(userKey(message), message)
+	})
+}
+
+func (processor *InboxProcessor) processMessage(message broker.Delivery) {
+	ctx := tracing.FromHeaders(context.Background(), message.Headers)
+	_, span := tracing.Start(ctx, "process "+message.Type, trace.WithSpanKind(trace.SpanKindConsumer))
+	defer span.End()
+	env, err := events.Parse(message.Body, message.Type, message.ID)
 	if err != nil {
-		return err
+		processor.deadLetters.Park(message, err)
+		return
+	}
+	if env.EventID == "" {
+		processor.deadLetters.Park(message, errors.New("message has no id"))
+		return
 	}
-	go func() {
-		for message := range messages {
-			processor.processMessage(message)
-		}
-	}()
-	return nil
-}
-func (processor *InboxProcessor) processMessage(message amqp.Delivery) {
 	var payload struct {
 		OrderID int64  `json:"order_id"`
 		UserID  int64  `json:"user_id"`
 		Status  string `json:"status"`
 	}
-	if err := json.Unmarshal(message.Body, &payload); err != nil {
-		log.Printf("order inbox: json error: %v", err)
-		message.Ack(false)
+	if err := env.Decode(&payload); err != nil {
+		processor.deadLetters.Park(message, err)
+		return
+	}
+	log.Printf("order inbox: received %s %s for order %d (correlation %s)", env.EventType, env.EventID, payload.OrderID, env.CorrelationID)
+	event := domain.OrderEvent(env.EventType)
+	if !slices.Contains(handledEvents, event) {
+		processor.deadLetters.Park(message, fmt.Errorf("unknown event type %q", env.EventType))
+		return
+	}
+	order, err := processor.repo.ApplyEvent(payload.OrderID, event, env.EventID, message.Body)
+	if errors.Is(err, repository.ErrDuplicateMessage) {
+		log.Printf("order inbox: %s %s was already processed", env.EventType, env.EventID)
+		message.Ack()
 		return
 	}
-	log.Printf("order inbox: received payment result for order %d: %s", payload.OrderID, payload.Status)
-	var newStatus domain.OrderStatus
-	switch payload.Status {
-	case "PaymentSucceeded":
-		newStatus = domain.OrderStatusFinished
-	case "PaymentFailed":
-		newStatus = domain.OrderStatusCancelled
-	default:
-		log.Printf("order inbox: unknown status: %s", payload.Status)
-		message.Ack(false)
+	if errors.Is(err, domain.ErrIllegalTransition) || errors.Is(err, repository.ErrOrderNotFound) {
+		log.Printf("order inbox: rejected %s for order %d: %v", event, payload.OrderID, err)
+		message.Ack()
 		return
 	}
-	_, err := processor.db.Exec(`
-    	UPDATE orders
-    	SET status = $1
-    	WHERE id = $2
-	`, string(newStatus), payload.OrderID)
 	if err != nil {
-		log.Printf("order inbox: update error: %v", err)
-		message.Nack(false, true)
+		tracing.Fail(span, err)
+		processor.deadLetters.Retry(message, err)
 		return
 	}
-	message.Ack(false)
+	log.Printf("order inbox: order %d is now %s", order.ID, order.Status)
+	message.Ack()
 }
@@ -1,91 +1,251 @@
 package outbox
 
 import (
+	"broker"
+	"broker/deadletter"
+	"context"
 	"database/sql"
+	"errors"
+	"expvar"
 	"log"
+	"shared/events"
+	sharedoutbox "shared/outbox"
+	"shared/tracing"
 	"time"
 
-	amqp "github.com/rabbitmq/amqp091-go"
+	"github.com/lib/pq"
+	"go.opentelemetry.io/otel/trace"
+)
+
+const (
+	// NotifyChannel is the Postgres channel the outbox insert trigger notifies.
+	NotifyChannel = "outbox_new"
+	batchSize     = 10
+	// ExchangeName is the topic exchange order events are published to, with
+	// events.RoutingKey of their type as routing key.
+	ExchangeName = "order_events"
+	// fallbackPollInterval only matters if a notification is lost; normally
+	// events are dispatched as soon as the inserting transaction commits.
+	fallbackPollInterval = 30 * time.Second
+	// minWakeupInterval keeps the loop from spinning on rows that are due but
+	// currently locked by another replica.
+	minWakeupInterval = 200 * time.Millisecond
+	// reconnectPollInterval is how often the loop checks whether the broker
+	// is back while it is unreachable.
+	reconnectPollInterval = time.Second
 )
 
 type OutboxProcessor struct {
-	db         *sql.DB
-	rabbitConn *amqp.Connection
-	rabbitCh   *amqp.Channel
+	db        *sql.DB
+	publisher broker.Publisher
+	listener  *pq.Listener
+	latency   *sharedoutbox.LatencyStats
+	// disconnected is set when the last batch found the broker unreachable,
+	// so the loop polls for it to come back instead of sleeping long.
+	disconnected bool
 }
 
-func NewOutboxProcessor(db *sql.DB, rabbitConn *amqp.Connection) (*OutboxProcessor, error) {
-	ch, err := rabbitConn.Channel()
+// NewOutboxProcessor declares the order events topology on b and creates a
+// processor that wakes up on notifications delivered to listener, which must
+// already LISTEN on NotifyChannel.
+func NewOutboxProcessor(db *sql.DB, b broker.Broker, listener *pq.Listener) (*OutboxProcessor, error) {
+	// payment-service consumes orders_queue and owns its dead-letter
+	// topology, but the arguments have to match wherever it is declared.
+	// Declaring it here keeps events routable before payment-service starts.
+	err := b.Declare(broker.Topology{
+		Exchanges: []broker.Exchange{{Name: ExchangeName, Kind: broker.Topic}},
+		Queues:    []broker.Queue{{Name: "orders_queue", DeadLetter: deadletter.DeadLetterTarget("orders_queue")}},
+		Bindings: []broker.Binding{
+			{Queue: "orders_queue", Exchange: ExchangeName, RoutingKey: events.RoutingKey("OrderCreated")},
+			{Queue: "orders_queue", Exchange: ExchangeName, RoutingKey: events.RoutingKey("OrderCancelled")},
+		},
+	})
 	if err != nil {
 		return nil, err
 	}
-	_, err = ch.QueueDeclare(
-		"orders_queue",
-		true,
-		false,
-		false,
-		false,
-		nil,
-	)
-	if err != nil {
-		return nil, err
+	latency := &sharedoutbox.LatencyStats{}
+	// expvar names are per process; the end-to-end test runs both services'
+	// outboxes in one, and only the first one's latency is exported there.
+	if expvar.Get("outbox_dispatch_latency") == nil {
+		expvar.Publish("outbox_dispatch_latency", latency)
 	}
 	return &OutboxProcessor{
-		db:         db,
-		rabbitConn: rabbitConn,
-		rabbitCh:   ch,
+		db:        db,
+		publisher: b,
+		listener:  listener,
+		latency:   latency,
 	}, nil
 }
 
 func (p *OutboxProcessor) Start() {
 	go func() {
-		ticker := time.NewTicker(3 * time.Second)
-		for range ticker.C {
-			p.processEvents()
+		timer := time.NewTimer(0)
+		for {
+			select {
+			case <-p.listener.Notify:
+				// A nil notification means the listener reconnected and
+				// may have missed some, which drain handles the same way.
+			case <-timer.C:
+			}
+			p.drain()
+			timer.Reset(p.nextWakeup())
 		}
 	}()
 }
 
-func (p *OutboxProcessor) processEvents() {
-	rows, err := p.db.Query(`
-	SELECT id, event_type, payload
-	FROM outbox 
-	WHERE status = 'new'
-	LIMIT 10
-	`)
+// nextWakeup returns how long to sleep until the earliest retry is due, so
+// backed-off rows are retried on time without waiting for the fallback poll.
+func (p *OutboxProcessor) nextWakeup() time.Duration {
+	if p.disconnected {
+		return reconnectPollInterval
+	}
+	var seconds sql.NullFloat64
+	err := p.db.QueryRow(`
+	SELECT EXTRACT(EPOCH FROM (MIN(next_attempt_at) - NOW()))
+	FROM outbox
+	WHERE status = 'new'`).Scan(&seconds)
+	if err != nil || !seconds.Valid {
+		return fallbackPollInterval
+	}
+	return min(max(time.Duration(seconds.Float64*float64(time.Second)), minWakeupInterval), fallbackPollInterval)
+}
+
+// drain publishes batches until the outbox has no more new rows or a batch
+// could not be published completely.
+func (p *OutboxProcessor) drain() {
+	for p.processEvents() == batchSize {
+	}
+}
+
+type outboxEvent struct {
+	id            int
+	eventID       string
+	eventType     string
+	correlationID string
+	payload       []byte
+	traceContext  []byte
+	attempts      int
+}
+
+// processEvents claims a batch of due new rows with FOR UPDATE SKIP LOCKED
+// and keeps them locked until they are published and marked processed, so
+// several order-service replicas never publish the same row concurrently. If
+// the process dies mid-batch the transaction rolls back and the rows are picked
+// up again, which keeps delivery at-least-once. Rows that fail are pushed back
+// with a backoff instead of blocking the next batch.
+func (p *OutboxProcessor) processEvents() int {
+	tx, err := p.db.Begin()
+	if err != nil {
+		log.Println("Error starting outbox transaction:", err)
+		return 0
+	}
+	defer tx.Rollback()
+	rows, err := tx.Query(`
+	SELECT id, COALESCE(event_id, id::TEXT), event_type, COALESCE(payload->>'correlation_id', ''), payload,
+	       COALESCE(trace_context, '{}'), attempts
+	FROM outbox
+	WHERE status = 'new' AND next_attempt_at <= NOW()
+	ORDER BY id
+	LIMIT $1
+	FOR UPDATE SKIP LOCKED
+	`, batchSize)
 	if err != nil {
 		log.Println("Error reading outbox rows:", err)
-		return
+		return 0
 	}
-	defer rows.Close()
+	var events []outboxEvent
 	for rows.Next() {
-		var id int
-		var eventType string
-		var payload []byte
-		if err := rows.Scan(&id, &eventType, &payload); err != nil {
+		var e outboxEvent
+		if err := rows.Scan(&e.id, &e.eventID, &e.eventType, &e.correlationID, &e.payload, &e.traceContext, &e.attempts); err != nil {
 			continue
 		}
-		err := p.rabbitCh.Publish(
-			"",
-			"orders_queue",
-			false,
-			false,
-			amqp.Publishing{
-				ContentType: "application/json",
-				Body:        payload,
-				Type:        eventType,
-			},
-		)
-		if err != nil {
-			log.Printf("Failed to publish event %d: %v", id, err)
+		events = append(events, e)
+	}
+	rows.Close()
+	published := 0
+	p.disconnected = false
+	msgs, spans := toMessages(events)
+	for i, publishErr := range p.publisher.Publish(context.Background(), msgs...) {
+		e := events[i]
+		if publishErr != nil {
+			tracing.Fail(spans[i], publishErr)
+		}
+		spans[i].End()
+		if errors.Is(publishErr, broker.ErrNotConnected) {
+			// Leave the row alone while the broker is unreachable instead
+			// of burning its attempts.
+			p.disconnected = true
 			continue
 		}
-
-		_, err = p.db.Exec("UPDATE outbox SET status = 'processed' WHERE id = $1", id)
+		if publishErr != nil {
+			if err := p.recordFailure(tx, e, publishErr); err != nil {
+				log.Printf("Failed to record failure for event %d: %v", e.id, err)
+				return 0
+			}
+			continue
+		}
+		var waitedSeconds float64
+		err = tx.QueryRow(`
+		UPDATE outbox SET status = 'processed', processed_at = clock_timestamp()
+		WHERE id = $1
+		RETURNING EXTRACT(EPOCH FROM (clock_timestamp() - created_at))`, e.id).Scan(&waitedSeconds)
 		if err != nil {
-			log.Printf("Failed to update status for event %d: %v", id, err)
-		} else {
-			log.Printf("Event %d sent to RabbitMQ!", id)
+			log.Printf("Failed to update status for event %d: %v", e.id, err)
+			return 0
+		}
+		waited := time.Duration(waitedSeconds * float64(time.Second))
+		p.latency.Observe(waited)
+		published++
+		log.Printf("Event %d (%s %s) confirmed by broker after %s", e.id, e.eventType, e.eventID, waited)
+	}
+	if err := tx.Commit(); err != nil {
+		log.Printf("Failed to commit outbox batch: %v", err)
+		return 0
+	}
+	return published
+}
+
+// recordFailure bumps the attempt counter of e and schedules the next try,
+// or moves the row to failed once MaxAttempts is reached.
+func (p *OutboxProcessor) recordFailure(tx *sql.Tx, e outboxEvent, cause error) error {
+	attempts := e.attempts + 1
+	status := "new"
+	if attempts >= sharedoutbox.MaxAttempts {
+		status = "failed"
+	}
+	delay := sharedoutbox.Backoff(attempts)
+	_, err := tx.Exec(`
+	UPDATE outbox
+	SET attempts = $1, last_error = $2, status = $3, next_attempt_at = NOW() + make_interval(secs => $4)
+	WHERE id = $5`, attempts, cause.Error(), status, delay.Seconds(), e.id)
+	if err != nil {
+		return err
+	}
+	if status == "failed" {
+		log.Printf("Event %d failed after %d attempts: %v", e.id, attempts, cause)
+	} else {
+		log.Printf("Event %d attempt %d failed, retrying in %s: %v", e.id, attempts, delay.Round(time.Millisecond), cause)
+	}
+	return nil
+}
+
+// toMessages turns batch into messages, each with a producer span that
+// continues the trace stored with its row and is carried in the headers.
+func toMessages(batch []outboxEvent) ([]broker.Message, []trace.Span) {
+	msgs := make([]broker.Message, len(batch))
+	spans := make([]trace.Span, len(batch))
+	for i, e := range batch {
+		ctx := tracing.Unmarshal(context.Background(), e.traceContext)
+		ctx, spans[i] = tracing.Start(ctx, "publish "+e.eventType, trace.WithSpanKind(trace.SpanKindProducer))
+		msgs[i] = broker.Message{
+			Exchange:      ExchangeName,
+			RoutingKey:    events.RoutingKey(e.eventType),
+			ID:            e.eventID,
+			Type:          e.eventType,
+			CorrelationID: e.correlationID,
+			Headers:       tracing.Headers(ctx),
+			Body:          e.payload,
 		}
 	}
+	return msgs, spans
 }
@@ -0,0 +1,57 @@
+package repository
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"order-service/internal/domain"
+	"time"
+)
+
+const (
+	DefaultOrdersPageSize = 20
+	MaxOrdersPageSize     = 100
+)
+
+var ErrInvalidCursor = errors.New("invalid cursor")
+
+// OrderFilter selects one page of a user's orders. Nil bounds are not applied.
+type OrderFilter struct {
+	UserID      int64
+	Statuses    []domain.OrderStatus
+	CreatedFrom *time.Time
+	CreatedTo   *time.Time
+	MinAmount   *int64
+	MaxAmount   *int64
+	Limit       int
+	After       *OrderCursor
+}
+
+// OrderCursor points at the last order of a page. Orders are listed by
+// (created_at, id) descending, so the next page starts strictly below it.
+type OrderCursor struct {
+	CreatedAt time.Time `json:"created_at"`
+	ID        int64     `json:"id"`
+}
+
+type OrderPage struct {
+	Orders     []domain.Order `json:"orders"`
+	NextCursor string         `json:"next_cursor,omitempty"`
+}
+
+func (c OrderCursor) Encode() string {
+	b, _ := json.Marshal(c)
+	return base64.RawURLEncoding.EncodeToString(b)
+}
+
+func DecodeOrderCursor(s string) (*OrderCursor, error) {
+	b, err := base64.RawURLEncoding.DecodeString(s)
+	if err != nil {
+		return nil, ErrInvalidCursor
+	}
+	c := &OrderCursor{}
+	if err := json.Unmarshal(b, c); err != nil || c.ID <= 0 {
+		return nil, ErrInvalidCursor
+	}
+	return c, nil
+}
@@ -1,10 +1,29 @@
 package repository
 
 import (
+	"context"
 	"database/sql"
 	"encoding/json"
+	"errors"
 	"fmt"
+	"math"
 	"order-service/internal/domain"
+	"shared/events"
+	"shared/tracing"
+	"time"
+
+	"github.com/lib/pq"
+)
+
+var (
+	ErrEmptyOrder      = errors.New("order has no items")
+	ErrProductNotFound = errors.New("product not found")
+	// ErrAmountTooLarge means the order total does not fit in int64.
+	ErrAmountTooLarge  = errors.New("order amount is too large")
+	ErrInvalidQuantity = errors.New("invalid item quantity")
+	ErrOrderNotFound   = errors.New("order not found")
+	// ErrDuplicateMessage means an inbox message was already handled.
+	ErrDuplicateMessage = errors.New("message already processed")
 )
 
 type OrderRepository struct {
@@ -15,35 +34,386 @@ func NewOrderRepository(db *sql.DB) *OrderRepository {
 	return &OrderRepository{db: db}
 }
 
-func (r *OrderRepository) CreateOrderWithOutbox(order *domain.Order) error {
+// CreateOrderWithOutbox prices order.Items from the product catalog, stores the
+// order with its items and enqueues OrderCreated in a single transaction.
+// order.Amount is always computed here; whatever the caller put there is ignored.
+func (r *OrderRepository) CreateOrderWithOutbox(ctx context.Context, order *domain.Order) error {
+	if len(order.Items) == 0 {
+		return ErrEmptyOrder
+	}
+	ctx, span := tracing.Start(ctx, "OrderRepository.CreateOrderWithOutbox")
+	defer span.End()
 	tx, err := r.db.Begin()
 	if err != nil {
 		return err
 	}
 	defer tx.Rollback()
+
+	prices, err := r.lookupPrices(tx, order.Items)
+	if err != nil {
+		return err
+	}
+	order.Amount = 0
+	for i := range order.Items {
+		price, ok := prices[order.Items[i].ProductID]
+		if !ok {
+			return fmt.Errorf("%w: %d", ErrProductNotFound, order.Items[i].ProductID)
+		}
+		order.Items[i].UnitPrice = price
+		quantity := order.Items[i].Quantity
+		if quantity <= 0 || quantity > domain.MaxItemQuantity {
+			return fmt.Errorf("%w: %d", ErrInvalidQuantity, quantity)
+		}
+		if price > 0 && quantity > (math.MaxInt64-order.Amount)/price {
+			return ErrAmountTooLarge
+		}
+		order.Amount += price * quantity
+	}
+
+	// The OrderCreated event id doubles as the correlation id of the whole
+	// checkout, so it is fixed before the order row is written.
+	correlationID := events.NewID()
 	queryOrder := `
-	INSERT INTO orders (user_id, amount, status) 
-	VALUES ($1, $2, $3)
+	INSERT INTO orders (user_id, amount, status, correlation_id)
+	VALUES ($1, $2, $3, $4)
 	RETURNING id, created_at, status`
-	err = tx.QueryRow(queryOrder, order.UserID, order.Amount, domain.OrderStatusNew).
+	err = tx.QueryRow(queryOrder, order.UserID, order.Amount, domain.OrderStatusNew, correlationID).
 		Scan(&order.ID, &order.CreatedAt, &order.Status)
 	if err != nil {
 		return fmt.Errorf("failed to insert order: %w", err)
 	}
-	payloadMap := map[string]interface{}{
+	if err := insertHistory(tx, order.ID, nil, order.Status, domain.OrderEventCreated, ""); err != nil {
+		return err
+	}
+	queryItem := `
+	INSERT INTO order_items (order_id, product_id, quantity, unit_price)
+	VALUES ($1, $2, $3, $4)`
+	for _, item := range order.Items {
+		_, err = tx.Exec(queryItem, order.ID, item.ProductID, item.Quantity, item.UnitPrice)
+		if err != nil {
+			return fmt.Errorf("failed to insert order item: %w", err)
+		}
+	}
+	env, err := events.New("OrderCreated", map[string]interface{}{
 		"order_id": order.ID,
 		"user_id":  order.UserID,
 		"amount":   order.Amount,
+		"items":    order.Items,
+	}, correlationID, "")
+	if err != nil {
+		return err
+	}
+	env.EventID = correlationID
+	if err := insertOutbox(ctx, tx, env); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+// CancelOrder cancels an order on behalf of the customer and enqueues
+// OrderCancelled so payment-service can refund it if it was already paid.
+// Which orders can be cancelled is decided by domain.OrderLifecycle.
+func (r *OrderRepository) CancelOrder(ctx context.Context, orderID int64) (*domain.Order, error) {
+	return r.cancel(ctx, orderID, domain.OrderEventCancelRequested, domain.CancelReasonCustomer)
+}
+
+// ExpireOrder cancels a new order that never got a payment result.
+func (r *OrderRepository) ExpireOrder(ctx context.Context, orderID int64) (*domain.Order, error) {
+	return r.cancel(ctx, orderID, domain.OrderEventPaymentTimedOut, domain.CancelReasonTimeout)
+}
+
+func (r *OrderRepository) cancel(ctx context.Context, orderID int64, event domain.OrderEvent, reason string) (*domain.Order, error) {
+	ctx, span := tracing.Start(ctx, "OrderRepository.cancel")
+	defer span.End()
+	tx, err := r.db.Begin()
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+	o, err := transition(tx, orderID, event, "")
+	if err != nil {
+		return nil, err
+	}
+	var correlationID sql.NullString
+	err = tx.QueryRow(`SELECT correlation_id FROM orders WHERE id = $1`, o.ID).Scan(&correlationID)
+	if err != nil {
+		return nil, fmt.Errorf("get order correlation id error: %w", err)
+	}
+	env, err := events.New("OrderCancelled", map[string]interface{}{
+		"order_id": o.ID,
+		"user_id":  o.UserID,
+		"amount":   o.Amount,
+		"status":   "OrderCancelled",
+		"reason":   reason,
+	}, correlationID.String, "")
+	if err != nil {
+		return nil, err
+	}
+	if err := insertOutbox(ctx, tx, env); err != nil {
+		return nil, err
+	}
+	if err := tx.Commit(); err != nil {
+		return nil, err
+	}
+	orders := []domain.Order{*o}
+	if err := r.loadItems(orders); err != nil {
+		return nil, err
+	}
+	return &orders[0], nil
+}
+
+// OverdueOrder is a new order whose payment result is late.
+type OverdueOrder struct {
+	ID      int64
+	Retries int
+}
+
+// ListOverdueOrders returns new orders whose payment was last requested more
+// than deadline ago.
+func (r *OrderRepository) ListOverdueOrders(deadline time.Duration, limit int) ([]OverdueOrder, error) {
+	rows, err := r.db.Query(`
+		SELECT id, payment_retries
+		FROM orders
+		WHERE status = $1 AND payment_requested_at < NOW() - make_interval(secs => $2)
+		ORDER BY payment_requested_at
+		LIMIT $3`, domain.OrderStatusNew, deadline.Seconds(), limit)
+	if err != nil {
+		return nil, fmt.Errorf("list overdue orders error: %w", err)
+	}
+	defer rows.Close()
+	var orders []OverdueOrder
+	for rows.Next() {
+		var o OverdueOrder
+		if err := rows.Scan(&o.ID, &o.Retries); err != nil {
+			return nil, err
+		}
+		orders = append(orders, o)
+	}
+	return orders, rows.Err()
+}
+
+// RepublishOrderCreated enqueues OrderCreated for an overdue order once more
+// and restarts its deadline. It returns false if the order is no longer
+// overdue, e.g. because its payment result arrived or another instance already
+// republished it.
+func (r *OrderRepository) RepublishOrderCreated(ctx context.Context, orderID int64, deadline time.Duration) (bool, error) {
+	tx, err := r.db.Begin()
+	if err != nil {
+		return false, err
+	}
+	defer tx.Rollback()
+	res, err := tx.Exec(`
+		UPDATE orders
+		SET payment_retries = payment_retries + 1, payment_requested_at = NOW()
+		WHERE id = $1 AND status = $2 AND payment_requested_at < NOW() - make_interval(secs => $3)`,
+		orderID, domain.OrderStatusNew, deadline.Seconds())
+	if err != nil {
+		return false, fmt.Errorf("failed to bump payment retries: %w", err)
+	}
+	if n, _ := res.RowsAffected(); n == 0 {
+		return false, nil
+	}
+	// The event is rebuilt from the order rather than copied from the
+	// outbox, whose row retention may already have archived or deleted. It
+	// gets a new event id but keeps the checkout's correlation id;
+	// payment-service tells a paid order from its hold, not from the event id.
+	var order domain.Order
+	var correlationID sql.NullString
+	err = tx.QueryRow(`SELECT user_id, amount, correlation_id FROM orders WHERE id = $1`, orderID).
+		Scan(&order.UserID, &order.Amount, &correlationID)
+	if err != nil {
+		return false, fmt.Errorf("failed to get order: %w", err)
+	}
+	rows, err := tx.Query(`
+		SELECT product_id, quantity, unit_price FROM order_items
+		WHERE order_id = $1 ORDER BY id`, orderID)
+	if err != nil {
+		return false, fmt.Errorf("failed to get order items: %w", err)
+	}
+	for rows.Next() {
+		var item domain.OrderItem
+		if err := rows.Scan(&item.ProductID, &item.Quantity, &item.UnitPrice); err != nil {
+			rows.Close()
+			return false, err
+		}
+		order.Items = append(order.Items, item)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return false, err
+	}
+	if len(order.Items) == 0 {
+		// Rolling back leaves the attempt uncounted, so the order is not
+		// timed out as if payment-service had been asked.
+		return false, fmt.Errorf("%w: order %d", ErrEmptyOrder, orderID)
+	}
+	env, err := events.New("OrderCreated", map[string]interface{}{
+		"order_id": orderID,
+		"user_id":  order.UserID,
+		"amount":   order.Amount,
+		"items":    order.Items,
+	}, correlationID.String, correlationID.String)
+	if err != nil {
+		return false, err
+	}
+	if err := insertOutbox(ctx, tx, env); err != nil {
+		return false, err
+	}
+	return true, tx.Commit()
+}
+
+// ApplyEvent moves an order through domain.OrderLifecycle in response to
+// event and records the change in order_status_history. The message that
+// carried the event is recorded in order_inbox_messages in the same
+// transaction, so a redelivery returns ErrDuplicateMessage and changes
+// nothing. Illegal transitions are returned as domain.ErrIllegalTransition
+// and leave the order untouched, but the message is still recorded as
+// rejected.
+func (r *OrderRepository) ApplyEvent(orderID int64, event domain.OrderEvent, eventID string, payload []byte) (*domain.Order, error) {
+	tx, err := r.db.Begin()
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+	res, err := tx.Exec(`
+		INSERT INTO order_inbox_messages (message_id, type, order_id, payload)
+		VALUES ($1, $2, $3, $4)
+		ON CONFLICT (message_id) DO NOTHING`, eventID, event, orderID, payload)
+	if err != nil {
+		return nil, fmt.Errorf("failed to insert inbox message: %w", err)
+	}
+	if n, _ := res.RowsAffected(); n == 0 {
+		return nil, ErrDuplicateMessage
+	}
+	o, err := transition(tx, orderID, event, eventID)
+	outcome := "applied"
+	if errors.Is(err, domain.ErrIllegalTransition) || errors.Is(err, ErrOrderNotFound) {
+		outcome = "rejected"
+	} else if err != nil {
+		return nil, err
+	}
+	_, updateErr := tx.Exec(`UPDATE order_inbox_messages SET outcome = $1 WHERE message_id = $2`, outcome, eventID)
+	if updateErr != nil {
+		return nil, fmt.Errorf("failed to update inbox message: %w", updateErr)
+	}
+	if commitErr := tx.Commit(); commitErr != nil {
+		return nil, commitErr
+	}
+	return o, err
+}
+
+func (r *OrderRepository) GetStatusHistory(orderID int64) ([]domain.OrderStatusChange, error) {
+	var exists bool
+	err := r.db.QueryRow(`SELECT EXISTS (SELECT 1 FROM orders WHERE id = $1)`, orderID).Scan(&exists)
+	if err != nil {
+		return nil, fmt.Errorf("get order history error: %w", err)
+	}
+	if !exists {
+		return nil, ErrOrderNotFound
+	}
+	rows, err := r.db.Query(`
+		SELECT id, order_id, from_status, to_status, cause, event_id, created_at
+		FROM order_status_history
+		WHERE order_id = $1
+		ORDER BY id`, orderID)
+	if err != nil {
+		return nil, fmt.Errorf("get order history error: %w", err)
+	}
+	defer rows.Close()
+	history := []domain.OrderStatusChange{}
+	for rows.Next() {
+		var c domain.OrderStatusChange
+		if err := rows.Scan(&c.ID, &c.OrderID, &c.FromStatus, &c.ToStatus, &c.Cause, &c.EventID, &c.CreatedAt); err != nil {
+			return nil, err
+		}
+		history = append(history, c)
 	}
-	payloadBytes, _ := json.Marshal(payloadMap)
-	queryOutbox := `
-	INSERT INTO outbox (event_type, payload, status)
-	VALUES ($1, $2, 'new')`
-	_, err = tx.Exec(queryOutbox, "OrderCreated", payloadBytes)
+	return history, rows.Err()
+}
+
+// transition locks the order row, checks event against the lifecycle and
+// applies it together with a history entry inside tx.
+func transition(tx *sql.Tx, orderID int64, event domain.OrderEvent, eventID string) (*domain.Order, error) {
+	o := &domain.Order{}
+	err := tx.QueryRow(`
+		SELECT id, user_id, amount, status, created_at
+		FROM orders
+		WHERE id = $1 FOR UPDATE`, orderID).
+		Scan(&o.ID, &o.UserID, &o.Amount, &o.Status, &o.CreatedAt)
+	if err != nil {
+		if err == sql.ErrNoRows {
+			return nil, ErrOrderNotFound
+		}
+		return nil, fmt.Errorf("select order for update error: %w", err)
+	}
+	next, err := domain.OrderLifecycle.Next(o.Status, event)
+	if err != nil {
+		return nil, err
+	}
+	_, err = tx.Exec(`UPDATE orders SET status = $1 WHERE id = $2`, next, o.ID)
+	if err != nil {
+		return nil, fmt.Errorf("failed to update order status: %w", err)
+	}
+	from := o.Status
+	o.Status = next
+	if err := insertHistory(tx, o.ID, &from, next, event, eventID); err != nil {
+		return nil, err
+	}
+	return o, nil
+}
+
+// insertOutbox enqueues env inside tx; the payload column holds the whole
+// envelope exactly as it will be published. The trace context of ctx is
+// stored with it, so the publish continues the trace that caused the event.
+func insertOutbox(ctx context.Context, tx *sql.Tx, env events.Envelope) error {
+	payload, err := json.Marshal(env)
+	if err != nil {
+		return fmt.Errorf("marshal %s envelope: %w", env.EventType, err)
+	}
+	_, err = tx.Exec(`
+	INSERT INTO outbox (event_type, payload, status, event_id, trace_context)
+	VALUES ($1, $2, 'new', $3, $4)`, env.EventType, payload, env.EventID, tracing.Marshal(ctx))
 	if err != nil {
 		return fmt.Errorf("failed to insert outbox: %w", err)
 	}
-	return tx.Commit()
+	return nil
+}
+
+func insertHistory(tx *sql.Tx, orderID int64, from *domain.OrderStatus, to domain.OrderStatus, cause domain.OrderEvent, eventID string) error {
+	var eventIDArg interface{}
+	if eventID != "" {
+		eventIDArg = eventID
+	}
+	_, err := tx.Exec(`
+	INSERT INTO order_status_history (order_id, from_status, to_status, cause, event_id)
+	VALUES ($1, $2, $3, $4, $5)`, orderID, from, to, cause, eventIDArg)
+	if err != nil {
+		return fmt.Errorf("failed to insert status history: %w", err)
+	}
+	return nil
+}
+
+// lookupPrices reads the current catalog price for every product in items.
+// Products missing from the catalog are simply absent from the result.
+func (r *OrderRepository) lookupPrices(tx *sql.Tx, items []domain.OrderItem) (map[int64]int64, error) {
+	ids := make([]int64, 0, len(items))
+	for _, item := range items {
+		ids = append(ids, item.ProductID)
+	}
+	rows, err := tx.Query(`SELECT id, price FROM products WHERE id = ANY($1)`, pq.Array(ids))
+	if err != nil {
+		return nil, fmt.Errorf("lookup product prices error: %w", err)
+	}
+	defer rows.Close()
+	prices := make(map[int64]int64, len(ids))
+	for rows.Next() {
+		var id, price int64
+		if err := rows.Scan(&id, &price); err != nil {
+			return nil, err
+		}
+		prices[id] = price
+	}
+	return prices, rows.Err()
 }
 
 func (r *OrderRepository) GetOrderByID(orderID int64) (*domain.Order, error) {
@@ -58,24 +428,61 @@ func (r *OrderRepository) GetOrderByID(orderID int64) (*domain.Order, error) {
 	)
 	if err != nil {
 		if err == sql.ErrNoRows {
-			return nil, fmt.Errorf("order not found")
+			return nil, ErrOrderNotFound
 		}
 		return nil, fmt.Errorf("get order by id error: %w", err)
 	}
-	return o, nil
+	orders := []domain.Order{*o}
+	if err := r.loadItems(orders); err != nil {
+		return nil, err
+	}
+	return &orders[0], nil
 }
 
-func (r *OrderRepository) GetOrdersByUserID(userID int64) ([]domain.Order, error) {
-	query := `SELECT id, user_id, amount, status, created_at 
-				FROM orders 
-				WHERE user_id = $1
-				ORDER BY created_at DESC`
-	rows, err := r.db.Query(query, userID)
+// ListOrders returns one page of a user's orders, newest first, using keyset
+// pagination on (created_at, id) so deep pages cost the same as the first one.
+func (r *OrderRepository) ListOrders(filter OrderFilter) (*OrderPage, error) {
+	if filter.Limit <= 0 || filter.Limit > MaxOrdersPageSize {
+		filter.Limit = DefaultOrdersPageSize
+	}
+	query := `SELECT id, user_id, amount, status, created_at
+				FROM orders
+				WHERE user_id = $1`
+	args := []interface{}{filter.UserID}
+	arg := func(v interface{}) string {
+		args = append(args, v)
+		return fmt.Sprintf("$%d", len(args))
+	}
+	if len(filter.Statuses) > 0 {
+		statuses := make([]string, 0, len(filter.Statuses))
+		for _, s := range filter.Statuses {
+			statuses = append(statuses, string(s))
+		}
+		query += ` AND status = ANY(` + arg(pq.Array(statuses)) + `)`
+	}
+	if filter.CreatedFrom != nil {
+		query += ` AND created_at >= ` + arg(filter.CreatedFrom.UTC())
+	}
+	if filter.CreatedTo != nil {
+		query += ` AND created_at < ` + arg(filter.CreatedTo.UTC())
+	}
+	if filter.MinAmount != nil {
+		query += ` AND amount >= ` + arg(*filter.MinAmount)
+	}
+	if filter.MaxAmount != nil {
+		query += ` AND amount <= ` + arg(*filter.MaxAmount)
+	}
+	if filter.After != nil {
+		query += ` AND (created_at, id) < (` + arg(filter.After.CreatedAt.UTC()) + `, ` + arg(filter.After.ID) + `)`
+	}
+	query += ` ORDER BY created_at DESC, id DESC LIMIT ` + arg(filter.Limit+1)
+
+	rows, err := r.db.Query(query, args...)
 	if err != nil {
-		return nil, fmt.Errorf("get orders by user_id error: %w", err)
+		return nil, fmt.Errorf("list orders error: %w", err)
 	}
 	defer rows.Close()
-	var orders []domain.Order
+	orders := []domain.Order{}
 	for rows.Next() {
 		var order domain.Order
 		if err := rows.Scan(&order.ID, &order.UserID, &order.Amount, &order.Status, &order.CreatedAt); err != nil {
@@ -83,5 +490,51 @@ func (r *OrderRepository) GetOrdersByUserID(userID int64) ([]domain.Order, error
 		}
 		orders = append(orders, order)
 	}
-	return orders, nil
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	page := &OrderPage{Orders: orders}
+	if len(orders) > filter.Limit {
+		page.Orders = orders[:filter.Limit]
+		last := page.Orders[len(page.Orders)-1]
+		page.NextCursor = OrderCursor{CreatedAt: last.CreatedAt, ID: last.ID}.Encode()
+	}
+	if err := r.loadItems(page.Orders); err != nil {
+		return nil, err
+	}
+	return page, nil
+}
+
+// loadItems fills Items for every order in place with a single query.
+func (r *OrderRepository) loadItems(orders []domain.Order) error {
+	if len(orders) == 0 {
+		return nil
+	}
+	ids := make([]int64, 0, len(orders))
+	byID := make(map[int64]*domain.Order, len(orders))
+	for i := range orders {
+		orders[i].Items = []domain.OrderItem{}
+		ids = append(ids, orders[i].ID)
+		byID[orders[i].ID] = &orders[i]
+	}
+	rows, err := r.db.Query(`
+		SELECT order_id, product_id, quantity, unit_price
+		FROM order_items
+		WHERE order_id = ANY($1)
+		ORDER BY id`, pq.Array(ids))
+	if err != nil {
+		return fmt.Errorf("get order items error: %w", err)
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var orderID int64
+		var item domain.OrderItem
+		if err := rows.Scan(&orderID, &item.ProductID, &item.Quantity, &item.UnitPrice); err != nil {
+			return err
+		}
+		if o, ok := byID[orderID]; ok {
+			o.Items = append(o.Items, item)
+		}
+	}
+	return rows.Err()
 }
@@ -0,0 +1,32 @@
+package repository
+
+import (
+	"database/sql"
+	"fmt"
+	"order-service/internal/domain"
+)
+
+type ProductRepository struct {
+	db *sql.DB
+}
+
+func NewProductRepository(db *sql.DB) *ProductRepository {
+	return &ProductRepository{db: db}
+}
+
+func (r *ProductRepository) ListProducts() ([]domain.Product, error) {
+	rows, err := r.db.Query(`SELECT id, name, price, created_at FROM products ORDER BY id`)
+	if err != nil {
+		return nil, fmt.Errorf("list products error: %w", err)
+	}
+	defer rows.Close()
+	products := []domain.Product{}
+	for rows.Next() {
+		var p domain.Product
+		if err := rows.Scan(&p.ID, &p.Name, &p.Price, &p.CreatedAt); err != nil {
+			return nil, err
+		}
+		products = append(products, p)
+	}
+	return products, rows.Err()
+}
@@ -0,0 +1,71 @@
+package sweeper
+
+import (
+	"context"
+	"errors"
+	"log"
+	"order-service/internal/domain"
+	"order-service/internal/repository"
+	"time"
+)
+
+type Config struct {
+	// Deadline is how long an order may wait for a payment result before
+	// OrderCreated is published again.
+	Deadline time.Duration
+	// MaxRetries is how many times OrderCreated is republished before the
+	// order is cancelled with the timeout reason.
+	MaxRetries int
+	Interval   time.Duration
+	BatchSize  int
+}
+
+// Sweeper watches for orders stuck in "new" because payment-service never
+// answered, and either nudges payment-service again or gives up on them.
+type Sweeper struct {
+	repo *repository.OrderRepository
+	cfg  Config
+}
+
+func NewSweeper(repo *repository.OrderRepository, cfg Config) *Sweeper {
+	return &Sweeper{repo: repo, cfg: cfg}
+}
+
+func (s *Sweeper) Start() {
+	go func() {
+		ticker := time.NewTicker(s.cfg.Interval)
+		for range ticker.C {
+			s.sweep()
+		}
+	}()
+}
+
+func (s *Sweeper) sweep() {
+	orders, err := s.repo.ListOverdueOrders(s.cfg.Deadline, s.cfg.BatchSize)
+	if err != nil {
+		log.Printf("order sweeper: %v", err)
+		return
+	}
+	for _, o := range orders {
+		if o.Retries < s.cfg.MaxRetries {
+			ok, err := s.repo.RepublishOrderCreated(context.Background(), o.ID, s.cfg.Deadline)
+			if err != nil {
+				log.Printf("order sweeper: republish error for order %d: %v", o.ID, err)
+			} else if ok {
+				log.Printf("order sweeper: order %d has no payment result, republished OrderCreated (%d/%d)",
+					o.ID, o.Retries+1, s.cfg.MaxRetries)
+			}
+			continue
+		}
+		_, err := s.repo.ExpireOrder(context.Background(), o.ID)
+		if errors.Is(err, domain.ErrIllegalTransition) {
+			// The payment result arrived between listing and expiring.
+			continue
+		}
+		if err != nil {
+			log.Printf("order sweeper: cancel error for order %d: %v", o.ID, err)
+			continue
+		}
+		log.Printf("order sweeper: order %d cancelled after %d retries without payment result", o.ID, o.Retries)
+	}
+}
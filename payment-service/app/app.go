@@ -0,0 +1,235 @@
+// Package app assembles payment-service: its schema, background processors
+// and HTTP API. cmd/main.go runs it on Postgres and RabbitMQ; the end-to-end
+// test in e2e runs it on broker.Memory.
+package app
+
+import (
+	"broker"
+	"broker/deadletter"
+	"database/sql"
+	"expvar"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"payment-service/internal/handler"
+	"payment-service/internal/inbox"
+	"payment-service/internal/ledger"
+	"payment-service/internal/outbox"
+	"payment-service/internal/repository"
+	"shared/idempotency"
+	"shared/retention"
+	"strconv"
+	"time"
+
+	"github.com/lib/pq"
+)
+
+// Config holds the settings of the background processors.
+type Config struct {
+	Inbox     inbox.Config
+	Retention retention.Config
+	// HoldExpiryInterval is how often overdue holds are expired.
+	HoldExpiryInterval time.Duration
+}
+
+// ConfigFromEnv reads Config from the environment, falling back to the
+// defaults for unset variables.
+func ConfigFromEnv() Config {
+	return Config{
+		Inbox: inbox.Config{
+			MaxRetries: envInt("INBOX_MAX_RETRIES", 5),
+			RetryDelay: envDuration("INBOX_RETRY_DELAY", 5*time.Second),
+			Prefetch:   envInt("INBOX_PREFETCH", 32),
+			Workers:    envInt("INBOX_WORKERS", 8),
+			HoldTTL:    envDuration("HOLD_TTL", ledger.DefaultHoldTTL),
+			// In manual mode orders are only authorized and are charged when
+			// their hold is captured, e.g. on shipment.
+			AutoCapture: os.Getenv("PAYMENT_CAPTURE_MODE") != "manual",
+		},
+		Retention: retention.Config{
+			MaxAge:    envDuration("OUTBOX_RETENTION", 7*24*time.Hour),
+			Archive:   os.Getenv("OUTBOX_RETENTION_MODE") != "delete",
+			Interval:  envDuration("OUTBOX_RETENTION_INTERVAL", 10*time.Minute),
+			BatchSize: 500,
+		},
+		HoldExpiryInterval: envDuration("HOLD_EXPIRY_INTERVAL", time.Minute),
+	}
+}
+
+// Start starts the inbox, the outbox and the background jobs of
+// payment-service on db and bus and returns its HTTP API. connStr is used to
+// LISTEN for outbox notifications. parked opens the AMQP channels the admin
+// API browses parked messages on; with nil those endpoints are left out.
+func Start(db *sql.DB, connStr string, bus broker.Broker, parked deadletter.ChannelOpener, cfg Config) (http.Handler, error) {
+	repo := repository.NewAccountRepository(db)
+	h := handler.NewAccountHandler(repo)
+	idempotencyStore := idempotency.NewStore(db, "payment_idempotency_keys", time.Minute)
+	deposit := idempotencyStore.Middleware("POST /accounts/deposit", h.Deposit)
+	withdraw := idempotencyStore.Middleware("POST /accounts/withdraw", h.Withdraw)
+	transfer := idempotencyStore.Middleware("POST /accounts/transfer", h.Transfer)
+	createHold := idempotencyStore.Middleware("POST /accounts/holds", h.CreateHold)
+
+	adminHandler := handler.NewAdminHandler(
+		db,
+		repository.NewOutboxRepository(db),
+		deadletter.NewParkingLot(parked, inbox.Queue),
+	)
+	healthHandler := handler.NewHealthHandler(bus.Connected)
+	inboxProc, err := inbox.NewInboxProcessor(db, repo, bus, cfg.Inbox)
+	if err != nil {
+		return nil, fmt.Errorf("inbox init failed: %w", err)
+	}
+	if err := inboxProc.Start(); err != nil {
+		return nil, fmt.Errorf("inbox start failed: %w", err)
+	}
+
+	listener := pq.NewListener(connStr, time.Second, time.Minute, nil)
+	if err := listener.Listen(outbox.NotifyChannel); err != nil {
+		return nil, fmt.Errorf("failed to listen for outbox notifications: %w", err)
+	}
+	outboxProc, err := outbox.NewOutboxProcessor(db, bus, listener)
+	if err != nil {
+		return nil, fmt.Errorf("payments outbox init failed: %w", err)
+	}
+	outboxProc.Start()
+	repository.NewHoldExpiryJob(repo, cfg.HoldExpiryInterval, 500).Start()
+	retention.NewJob(db, retention.Table{Name: "outbox_events", Archive: "outbox_events_archive", TypeColumn: "type"}, cfg.Retention).Start()
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/accounts", func(w http.ResponseWriter, r *http.Request) {
+		if r.Method == http.MethodPost {
+			h.CreateAccount(w, r)
+		} else {
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		}
+	})
+	mux.HandleFunc("/accounts/deposit", func(w http.ResponseWriter, r *http.Request) {
+		if r.Method == http.MethodPost {
+			deposit(w, r)
+		} else {
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		}
+	})
+	mux.HandleFunc("/accounts/withdraw", func(w http.ResponseWriter, r *http.Request) {
+		if r.Method == http.MethodPost {
+			withdraw(w, r)
+		} else {
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		}
+	})
+	mux.HandleFunc("/accounts/transfer", func(w http.ResponseWriter, r *http.Request) {
+		if r.Method == http.MethodPost {
+			transfer(w, r)
+		} else {
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		}
+	})
+	mux.HandleFunc("/accounts/holds", func(w http.ResponseWriter, r *http.Request) {
+		if r.Method == http.MethodPost {
+			createHold(w, r)
+		} else {
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		}
+	})
+	mux.HandleFunc("/accounts/holds/{id}/capture", func(w http.ResponseWriter, r *http.Request) {
+		if r.Method == http.MethodPost {
+			h.CaptureHold(w, r)
+		} else {
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		}
+	})
+	mux.HandleFunc("/accounts/holds/{id}/void", func(w http.ResponseWriter, r *http.Request) {
+		if r.Method == http.MethodPost {
+			h.VoidHold(w, r)
+		} else {
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		}
+	})
+	mux.HandleFunc("/accounts/transactions", func(w http.ResponseWriter, r *http.Request) {
+		if r.Method == http.MethodGet {
+			h.ListTransactions(w, r)
+		} else {
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		}
+	})
+	mux.HandleFunc("/accounts/balance", func(w http.ResponseWriter, r *http.Request) {
+		if r.Method == http.MethodGet {
+			h.GetBalance(w, r)
+		} else {
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		}
+	})
+	mux.HandleFunc("/admin/outbox/failed", func(w http.ResponseWriter, r *http.Request) {
+		if r.Method == http.MethodGet {
+			adminHandler.ListFailedOutbox(w, r)
+		} else {
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		}
+	})
+	mux.HandleFunc("/admin/outbox/{id}/requeue", func(w http.ResponseWriter, r *http.Request) {
+		if r.Method == http.MethodPost {
+			adminHandler.RequeueOutbox(w, r)
+		} else {
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		}
+	})
+	mux.HandleFunc("/admin/ledger/verify", func(w http.ResponseWriter, r *http.Request) {
+		if r.Method == http.MethodGet {
+			adminHandler.VerifyLedger(w, r)
+		} else {
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		}
+	})
+	// Parked messages are browsed over AMQP, so there is nothing to show
+	// without RabbitMQ.
+	if parked != nil {
+		mux.HandleFunc("/admin/parked", func(w http.ResponseWriter, r *http.Request) {
+			if r.Method == http.MethodGet {
+				adminHandler.ListParked(w, r)
+			} else {
+				http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			}
+		})
+		mux.HandleFunc("/admin/parked/{id}/replay", func(w http.ResponseWriter, r *http.Request) {
+			if r.Method == http.MethodPost {
+				adminHandler.ReplayParked(w, r)
+			} else {
+				http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			}
+		})
+	}
+	mux.HandleFunc("/health", func(w http.ResponseWriter, r *http.Request) {
+		if r.Method == http.MethodGet {
+			healthHandler.Check(w, r)
+		} else {
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		}
+	})
+	mux.Handle("/debug/vars", expvar.Handler())
+	return mux, nil
+}
+
+func envDuration(name string, def time.Duration) time.Duration {
+	v := os.Getenv(name)
+	if v == "" {
+		return def
+	}
+	d, err := time.ParseDuration(v)
+	if err != nil {
+		log.Fatalf("invalid %s: %v", name, err)
+	}
+	return d
+}
+
+func envInt(name string, def int) int {
+	v := os.Getenv(name)
+	if v == "" {
+		return def
+	}
+	n, err := strconv.Atoi(v)
+	if err != nil {
+		log.Fatalf("invalid %s: %v", name, err)
+	}
+	return n
+}
@@ -0,0 +1,196 @@
+package app
+
+import (
+	"database/sql"
+	"fmt"
+	"log"
+)
+
+// Migrate creates or upgrades the tables, indexes and triggers
+// payment-service needs. Every statement is idempotent, so it runs on every
+// start.
+func Migrate(db *sql.DB) error {
+	query := `
+    CREATE TABLE IF NOT EXISTS accounts (
+        id SERIAL PRIMARY KEY,
+        user_id BIGINT UNIQUE,
+        code VARCHAR(50) UNIQUE,
+        balance BIGINT NOT NULL DEFAULT 0,
+        created_at TIMESTAMP WITH TIME ZONE NOT NULL DEFAULT NOW()
+    );
+    -- System accounts of the ledger have a code instead of a user_id.
+    ALTER TABLE accounts ALTER COLUMN user_id DROP NOT NULL;
+    ALTER TABLE accounts ADD COLUMN IF NOT EXISTS code VARCHAR(50) UNIQUE;
+    INSERT INTO accounts (code) VALUES ('cash-in'), ('merchant-revenue') ON CONFLICT (code) DO NOTHING;
+    CREATE TABLE IF NOT EXISTS account_transactions (
+        id SERIAL PRIMARY KEY,
+        account_id BIGINT NOT NULL REFERENCES accounts(id),
+        amount BIGINT NOT NULL,
+        order_id BIGINT,
+        created_at TIMESTAMP WITH TIME ZONE NOT NULL DEFAULT NOW()
+    );
+    ALTER TABLE account_transactions ADD COLUMN IF NOT EXISTS order_id BIGINT;
+    ALTER TABLE account_transactions ADD COLUMN IF NOT EXISTS kind VARCHAR(20);
+    CREATE TABLE IF NOT EXISTS transfers (
+        id SERIAL PRIMARY KEY,
+        from_account_id BIGINT NOT NULL REFERENCES accounts(id),
+        to_account_id BIGINT NOT NULL REFERENCES accounts(id),
+        amount BIGINT NOT NULL CHECK (amount > 0),
+        created_at TIMESTAMP WITH TIME ZONE NOT NULL DEFAULT NOW()
+    );
+    ALTER TABLE account_transactions ADD COLUMN IF NOT EXISTS transfer_id BIGINT REFERENCES transfers(id);
+    CREATE INDEX IF NOT EXISTS idx_account_transactions_transfer_id ON account_transactions (transfer_id);
+    CREATE INDEX IF NOT EXISTS idx_account_transactions_order_id ON account_transactions (order_id);
+    ALTER TABLE account_transactions ADD COLUMN IF NOT EXISTS balance_after BIGINT;
+    CREATE INDEX IF NOT EXISTS idx_account_transactions_account_created ON account_transactions (account_id, created_at DESC, id DESC);
+    -- Rows written before kind and balance_after existed: kind follows from
+    -- the order reference and the sign, the running balance is replayed
+    -- backwards from the current balance.
+    UPDATE account_transactions SET kind = CASE
+            WHEN order_id IS NULL THEN 'deposit'
+            WHEN amount < 0 THEN 'payment'
+            ELSE 'refund'
+        END
+    WHERE kind IS NULL;
+    UPDATE account_transactions t SET balance_after = r.balance_after
+    FROM (
+        SELECT at.id, a.user_id, a.balance
+            - SUM(at.amount) OVER (PARTITION BY at.account_id)
+            + SUM(at.amount) OVER (PARTITION BY at.account_id ORDER BY at.id) AS balance_after
+        FROM account_transactions at
+        JOIN accounts a ON a.id = at.account_id
+    ) r
+    WHERE t.id = r.id AND t.balance_after IS NULL AND r.user_id IS NOT NULL;
+    CREATE TABLE IF NOT EXISTS journal_entries (
+        id BIGSERIAL PRIMARY KEY,
+        kind VARCHAR(20) NOT NULL,
+        created_at TIMESTAMP WITH TIME ZONE NOT NULL DEFAULT NOW()
+    );
+    ALTER TABLE account_transactions ADD COLUMN IF NOT EXISTS entry_id BIGINT REFERENCES journal_entries(id);
+    CREATE INDEX IF NOT EXISTS idx_account_transactions_entry_id ON account_transactions (entry_id);
+    -- Rows written before the ledger were single-sided: give each its own
+    -- journal entry with the matching system account posting, and put both
+    -- legs of a transfer in one entry.
+    DO $$
+    DECLARE
+        t RECORD;
+        entry BIGINT;
+    BEGIN
+        IF NOT EXISTS (SELECT 1 FROM account_transactions WHERE entry_id IS NULL) THEN
+            RETURN;
+        END IF;
+        LOCK TABLE account_transactions IN EXCLUSIVE MODE;
+        FOR t IN SELECT id, kind, amount, order_id, transfer_id, created_at
+                 FROM account_transactions WHERE entry_id IS NULL ORDER BY id LOOP
+            entry := NULL;
+            IF t.transfer_id IS NOT NULL THEN
+                SELECT entry_id INTO entry FROM account_transactions
+                WHERE transfer_id = t.transfer_id AND entry_id IS NOT NULL LIMIT 1;
+            END IF;
+            IF entry IS NULL THEN
+                INSERT INTO journal_entries (kind, created_at) VALUES (t.kind, t.created_at) RETURNING id INTO entry;
+            END IF;
+            UPDATE account_transactions SET entry_id = entry WHERE id = t.id;
+            IF t.transfer_id IS NULL THEN
+                INSERT INTO account_transactions (entry_id, account_id, amount, kind, order_id, created_at)
+                SELECT entry, id, -t.amount, t.kind, t.order_id, t.created_at FROM accounts
+                WHERE code = CASE WHEN t.kind IN ('payment', 'refund') THEN 'merchant-revenue' ELSE 'cash-in' END;
+            END IF;
+        END LOOP;
+    END $$;
+    CREATE TABLE IF NOT EXISTS holds (
+        id BIGSERIAL PRIMARY KEY,
+        account_id BIGINT NOT NULL REFERENCES accounts(id),
+        order_id BIGINT,
+        amount BIGINT NOT NULL CHECK (amount > 0),
+        status VARCHAR(20) NOT NULL,
+        expires_at TIMESTAMP WITH TIME ZONE NOT NULL,
+        created_at TIMESTAMP WITH TIME ZONE NOT NULL DEFAULT NOW(),
+        updated_at TIMESTAMP WITH TIME ZONE NOT NULL DEFAULT NOW()
+    );
+    CREATE INDEX IF NOT EXISTS idx_holds_account_authorized ON holds (account_id) WHERE status = 'authorized';
+    CREATE INDEX IF NOT EXISTS idx_holds_expires_authorized ON holds (expires_at) WHERE status = 'authorized';
+    CREATE INDEX IF NOT EXISTS idx_holds_order_id ON holds (order_id);
+    -- Orders paid before holds existed get a settled hold, since whether an
+    -- order is paid is read from its hold.
+    INSERT INTO holds (account_id, order_id, amount, status, expires_at, created_at, updated_at)
+    SELECT t.account_id, t.order_id, -t.amount,
+           CASE WHEN EXISTS (SELECT 1 FROM account_transactions r
+                             WHERE r.order_id = t.order_id AND r.account_id = t.account_id AND r.kind = 'refund')
+                THEN 'refunded' ELSE 'captured' END,
+           t.created_at, t.created_at, t.created_at
+    FROM account_transactions t
+    WHERE t.kind = 'payment' AND t.amount < 0 AND t.order_id IS NOT NULL
+      AND NOT EXISTS (SELECT 1 FROM holds h WHERE h.order_id = t.order_id);
+    CREATE TABLE IF NOT EXISTS inbox_messages (
+        id SERIAL PRIMARY KEY,
+        message_id VARCHAR(255) NOT NULL UNIQUE,
+        type VARCHAR(100) NOT NULL,
+        payload JSONB NOT NULL,
+        created_at TIMESTAMP WITH TIME ZONE NOT NULL DEFAULT NOW()
+    );
+    ALTER TABLE inbox_messages ADD COLUMN IF NOT EXISTS order_id BIGINT;
+    ALTER TABLE inbox_messages ADD COLUMN IF NOT EXISTS result JSONB;
+    CREATE INDEX IF NOT EXISTS idx_inbox_messages_order_id ON inbox_messages (order_id);
+    CREATE TABLE IF NOT EXISTS payment_idempotency_keys (
+        key VARCHAR(255) NOT NULL,
+        scope VARCHAR(100) NOT NULL,
+        fingerprint VARCHAR(64) NOT NULL,
+        status VARCHAR(20) NOT NULL DEFAULT 'processing',
+        response_code INT,
+        response_body BYTEA,
+        response_content_type VARCHAR(100),
+        locked_at TIMESTAMP WITH TIME ZONE NOT NULL DEFAULT NOW(),
+        created_at TIMESTAMP WITH TIME ZONE NOT NULL DEFAULT NOW(),
+        completed_at TIMESTAMP WITH TIME ZONE,
+        PRIMARY KEY (key, scope)
+    );
+    CREATE TABLE IF NOT EXISTS outbox_events (
+        id SERIAL PRIMARY KEY,
+        type VARCHAR(100) NOT NULL,
+        payload JSONB NOT NULL,
+        status VARCHAR(20) NOT NULL DEFAULT 'pending',
+        attempts INT NOT NULL DEFAULT 0,
+        last_error TEXT,
+        next_attempt_at TIMESTAMP WITH TIME ZONE NOT NULL DEFAULT NOW(),
+        created_at TIMESTAMP WITH TIME ZONE NOT NULL DEFAULT NOW(),
+        processed_at TIMESTAMP WITH TIME ZONE
+    );
+    ALTER TABLE outbox_events ADD COLUMN IF NOT EXISTS processed_at TIMESTAMP WITH TIME ZONE;
+    ALTER TABLE outbox_events ADD COLUMN IF NOT EXISTS attempts INT NOT NULL DEFAULT 0;
+    ALTER TABLE outbox_events ADD COLUMN IF NOT EXISTS last_error TEXT;
+    ALTER TABLE outbox_events ADD COLUMN IF NOT EXISTS next_attempt_at TIMESTAMP WITH TIME ZONE NOT NULL DEFAULT NOW();
+    ALTER TABLE outbox_events ADD COLUMN IF NOT EXISTS event_id VARCHAR(36);
+    ALTER TABLE outbox_events ADD COLUMN IF NOT EXISTS trace_context JSONB;
+    CREATE INDEX IF NOT EXISTS idx_outbox_events_due ON outbox_events (next_attempt_at) WHERE status = 'pending';
+    CREATE TABLE IF NOT EXISTS outbox_events_archive (
+        id BIGINT NOT NULL,
+        event_id VARCHAR(36),
+        trace_context JSONB,
+        type VARCHAR(100) NOT NULL,
+        payload JSONB NOT NULL,
+        status VARCHAR(20) NOT NULL,
+        attempts INT NOT NULL DEFAULT 0,
+        last_error TEXT,
+        created_at TIMESTAMP WITH TIME ZONE NOT NULL,
+        processed_at TIMESTAMP WITH TIME ZONE,
+        archived_at TIMESTAMP WITH TIME ZONE NOT NULL DEFAULT NOW()
+    ) PARTITION BY RANGE (archived_at);
+    ALTER TABLE outbox_events_archive ADD COLUMN IF NOT EXISTS event_id VARCHAR(36);
+    ALTER TABLE outbox_events_archive ADD COLUMN IF NOT EXISTS trace_context JSONB;
+    CREATE OR REPLACE FUNCTION notify_outbox_events_new() RETURNS trigger AS $$
+    BEGIN
+        PERFORM pg_notify('outbox_events_new', '');
+        RETURN NULL;
+    END;
+    $$ LANGUAGE plpgsql;
+    CREATE OR REPLACE TRIGGER outbox_events_notify_new
+        AFTER INSERT ON outbox_events
+        FOR EACH STATEMENT EXECUTE FUNCTION notify_outbox_events_new();`
+	_, err := db.Exec(query)
+	if err != nil {
+		return fmt.Errorf("exec schema: %w", err)
+	}
+	log.Println("payments_db tables created/checked")
+	return nil
+}
@@ -1,12 +1,40 @@
 package domain
 
-import "time"
+import (
+	"encoding/json"
+	"time"
+)
 
 type PaymentStatus string
 
 const (
-	PaymentStatusSuccess PaymentStatus = "success"
-	PaymentStatusFailed  PaymentStatus = "failed"
+	PaymentStatusSuccess  PaymentStatus = "success"
+	PaymentStatusFailed   PaymentStatus = "failed"
+	PaymentStatusRefunded PaymentStatus = "refunded"
+)
+
+// TransactionKind says what an account_transactions row was for.
+type TransactionKind string
+
+const (
+	TransactionKindDeposit    TransactionKind = "deposit"
+	TransactionKindPayment    TransactionKind = "payment"
+	TransactionKindRefund     TransactionKind = "refund"
+	TransactionKindWithdrawal TransactionKind = "withdrawal"
+	TransactionKindTransfer   TransactionKind = "transfer"
+)
+
+// HoldStatus is the state of a hold on account funds. Only authorized holds
+// that have not reached their expiry reduce the available balance.
+type HoldStatus string
+
+const (
+	HoldStatusAuthorized HoldStatus = "authorized"
+	HoldStatusCaptured   HoldStatus = "captured"
+	HoldStatusVoided     HoldStatus = "voided"
+	HoldStatusExpired    HoldStatus = "expired"
+	// HoldStatusRefunded marks a captured order hold whose order was refunded.
+	HoldStatusRefunded HoldStatus = "refunded"
 )
 
 type Account struct {
@@ -15,3 +43,56 @@ type Account struct {
 	Balance   int64     `json:"balance"`
 	CreatedAt time.Time `json:"created_at"`
 }
+
+// Transaction is one account_transactions row. OrderID is set for payments
+// and refunds, TransferID for transfers. BalanceAfter is the account balance
+// right after the entry.
+type Transaction struct {
+	ID           int64           `json:"id"`
+	Kind         TransactionKind `json:"kind"`
+	Amount       int64           `json:"amount"`
+	BalanceAfter int64           `json:"balance_after"`
+	OrderID      *int64          `json:"order_id,omitempty"`
+	TransferID   *int64          `json:"transfer_id,omitempty"`
+	CreatedAt    time.Time       `json:"created_at"`
+}
+
+// Balance is an account balance together with the part of it not reserved
+// by holds.
+type Balance struct {
+	UserID    int64 `json:"user_id"`
+	Balance   int64 `json:"balance"`
+	Available int64 `json:"available"`
+}
+
+// Hold reserves Amount of an account's balance until it is captured, voided
+// or reaches ExpiresAt. OrderID is set for holds taken for an order.
+type Hold struct {
+	ID        int64      `json:"id"`
+	AccountID int64      `json:"-"`
+	UserID    int64      `json:"user_id"`
+	OrderID   *int64     `json:"order_id,omitempty"`
+	Amount    int64      `json:"amount"`
+	Status    HoldStatus `json:"status"`
+	ExpiresAt time.Time  `json:"expires_at"`
+	CreatedAt time.Time  `json:"created_at"`
+}
+
+type Transfer struct {
+	ID         int64     `json:"id"`
+	FromUserID int64     `json:"from_user_id"`
+	ToUserID   int64     `json:"to_user_id"`
+	Amount     int64     `json:"amount"`
+	CreatedAt  time.Time `json:"created_at"`
+}
+
+type OutboxEvent struct {
+	ID            int64           `json:"id"`
+	Type          string          `json:"type"`
+	Payload       json.RawMessage `json:"payload"`
+	Status        string          `json:"status"`
+	Attempts      int             `json:"attempts"`
+	LastError     *string         `json:"last_error"`
+	NextAttemptAt time.Time       `json:"next_attempt_at"`
+	CreatedAt     time.Time       `json:"created_at"`
+}
@@ -1,10 +1,18 @@
 package handler
 
 import (
+	"context"
 	"encoding/json"
+	"errors"
+	"fmt"
 	"net/http"
+	"net/url"
+	"payment-service/internal/domain"
+	"payment-service/internal/ledger"
 	"payment-service/internal/repository"
 	"strconv"
+	"strings"
+	"time"
 )
 
 type AccountHandler struct {
@@ -25,7 +33,7 @@ func (h *AccountHandler) CreateAccount(w http.ResponseWriter, r *http.Request) {
 	}
 	acc, err := h.repo.CreateAccount(req.UserID)
 	if err != nil {
-		http.Error(w, "failed to create account: "+err.Error(), http.StatusBadRequest)
+		http.Error(w, "failed to create account: "+err.Error(), http.StatusInternalServerError)
 		return
 	}
 	w.Header().Set("Content-Type", "application/json")
@@ -42,13 +50,17 @@ func (h *AccountHandler) Deposit(w http.ResponseWriter, r *http.Request) {
 		http.Error(w, "invalid body", http.StatusBadRequest)
 		return
 	}
-	acc, err := h.repo.Deposit(req.UserID, req.Amount)
+	acc, err := h.repo.Deposit(r.Context(), req.UserID, req.Amount)
 	if err != nil {
 		if err == repository.ErrAccountNotFound {
 			http.Error(w, "account not found", http.StatusNotFound)
 			return
 		}
-		http.Error(w, "failed to deposit: "+err.Error(), http.StatusBadRequest)
+		if isValidationError(err) {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		http.Error(w, "failed to deposit: "+err.Error(), http.StatusInternalServerError)
 		return
 	}
 	w.Header().Set("Content-Type", "application/json")
@@ -56,6 +68,69 @@ func (h *AccountHandler) Deposit(w http.ResponseWriter, r *http.Request) {
 	_ = json.NewEncoder(w).Encode(acc)
 }
 
+func (h *AccountHandler) Withdraw(w http.ResponseWriter, r *http.Request) {
+	var req struct {
+		UserID int64 `json:"user_id"`
+		Amount int64 `json:"amount"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, "invalid body", http.StatusBadRequest)
+		return
+	}
+	acc, err := h.repo.Withdraw(r.Context(), req.UserID, req.Amount)
+	if err != nil {
+		if errors.Is(err, repository.ErrAccountNotFound) {
+			http.Error(w, "account not found", http.StatusNotFound)
+			return
+		}
+		if errors.Is(err, repository.ErrInsufficientFunds) {
+			http.Error(w, err.Error(), http.StatusPaymentRequired)
+			return
+		}
+		if isValidationError(err) {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		http.Error(w, "failed to withdraw: "+err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	_ = json.NewEncoder(w).Encode(acc)
+}
+
+func (h *AccountHandler) Transfer(w http.ResponseWriter, r *http.Request) {
+	var req struct {
+		FromUserID int64 `json:"from_user_id"`
+		ToUserID   int64 `json:"to_user_id"`
+		Amount     int64 `json:"amount"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, "invalid body", http.StatusBadRequest)
+		return
+	}
+	transfer, err := h.repo.Transfer(r.Context(), req.FromUserID, req.ToUserID, req.Amount)
+	if err != nil {
+		if errors.Is(err, repository.ErrAccountNotFound) {
+			http.Error(w, "account not found", http.StatusNotFound)
+			return
+		}
+		if errors.Is(err, repository.ErrInsufficientFunds) {
+			http.Error(w, err.Error(), http.StatusPaymentRequired)
+			return
+		}
+		if isValidationError(err) {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		http.Error(w, "failed to transfer: "+err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusCreated)
+	_ = json.NewEncoder(w).Encode(transfer)
+}
+
 func (h *AccountHandler) GetBalance(w http.ResponseWriter, r *http.Request) {
 	userIDStr := r.URL.Query().Get("user_id")
 	if userIDStr == "" {
@@ -67,7 +142,7 @@ func (h *AccountHandler) GetBalance(w http.ResponseWriter, r *http.Request) {
 		http.Error(w, "invalid user_id parameter", http.StatusBadRequest)
 		return
 	}
-	acc, err := h.repo.GetAccountByUserID(userID)
+	balance, err := h.repo.GetBalance(userID)
 	if err != nil {
 		if err == repository.ErrAccountNotFound {
 			http.Error(w, "account not found", http.StatusNotFound)
@@ -76,11 +151,150 @@ func (h *AccountHandler) GetBalance(w http.ResponseWriter, r *http.Request) {
 		http.Error(w, "failed to get account: "+err.Error(), http.StatusInternalServerError)
 		return
 	}
-	resp := map[string]interface{}{
-		"user_id": userID,
-		"balance": acc.Balance,
-	}
 	w.Header().Set("Content-Type", "application/json")
 	w.WriteHeader(http.StatusOK)
-	_ = json.NewEncoder(w).Encode(resp)
+	_ = json.NewEncoder(w).Encode(balance)
+}
+
+func (h *AccountHandler) CreateHold(w http.ResponseWriter, r *http.Request) {
+	var req struct {
+		UserID     int64 `json:"user_id"`
+		Amount     int64 `json:"amount"`
+		TTLSeconds int64 `json:"ttl_seconds"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, "invalid body", http.StatusBadRequest)
+		return
+	}
+	if req.TTLSeconds < 0 {
+		http.Error(w, "ttl_seconds can not be negative", http.StatusBadRequest)
+		return
+	}
+	ttl := ledger.DefaultHoldTTL
+	if req.TTLSeconds != 0 {
+		ttl = time.Duration(req.TTLSeconds) * time.Second
+	}
+	hold, err := h.repo.AuthorizeHold(r.Context(), req.UserID, req.Amount, ttl)
+	if err != nil {
+		if errors.Is(err, repository.ErrAccountNotFound) {
+			http.Error(w, "account not found", http.StatusNotFound)
+			return
+		}
+		if errors.Is(err, repository.ErrInsufficientFunds) {
+			http.Error(w, err.Error(), http.StatusPaymentRequired)
+			return
+		}
+		if isValidationError(err) {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		http.Error(w, "failed to authorize hold: "+err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusCreated)
+	_ = json.NewEncoder(w).Encode(hold)
+}
+
+func (h *AccountHandler) CaptureHold(w http.ResponseWriter, r *http.Request) {
+	h.settleHold(w, r, h.repo.CaptureHold)
+}
+
+func (h *AccountHandler) VoidHold(w http.ResponseWriter, r *http.Request) {
+	h.settleHold(w, r, h.repo.VoidHold)
+}
+
+func (h *AccountHandler) settleHold(w http.ResponseWriter, r *http.Request, settle func(context.Context, int64) (*domain.Hold, error)) {
+	holdID, err := strconv.ParseInt(r.PathValue("id"), 10, 64)
+	if err != nil {
+		http.Error(w, "invalid id parameter", http.StatusBadRequest)
+		return
+	}
+	hold, err := settle(r.Context(), holdID)
+	if err != nil {
+		if errors.Is(err, ledger.ErrHoldNotFound) {
+			http.Error(w, "hold not found", http.StatusNotFound)
+			return
+		}
+		if errors.Is(err, ledger.ErrHoldNotActive) || errors.Is(err, repository.ErrOrderHold) {
+			http.Error(w, err.Error(), http.StatusConflict)
+			return
+		}
+		http.Error(w, "failed to settle hold: "+err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	_ = json.NewEncoder(w).Encode(hold)
+}
+
+func (h *AccountHandler) ListTransactions(w http.ResponseWriter, r *http.Request) {
+	query := r.URL.Query()
+	userIDStr := query.Get("user_id")
+	if userIDStr == "" {
+		http.Error(w, "missing user_id parameter", http.StatusBadRequest)
+		return
+	}
+	userID, err := strconv.ParseInt(userIDStr, 10, 64)
+	if err != nil {
+		http.Error(w, "invalid user_id parameter", http.StatusBadRequest)
+		return
+	}
+	filter := repository.TransactionFilter{UserID: userID}
+	if v := query.Get("limit"); v != "" {
+		filter.Limit, err = strconv.Atoi(v)
+		if err != nil || filter.Limit <= 0 || filter.Limit > repository.MaxTransactionsPageSize {
+			http.Error(w, fmt.Sprintf("limit must be between 1 and %d", repository.MaxTransactionsPageSize), http.StatusBadRequest)
+			return
+		}
+	}
+	if v := query.Get("cursor"); v != "" {
+		filter.After, err = repository.DecodeTransactionCursor(v)
+		if err != nil {
+			http.Error(w, "invalid cursor parameter", http.StatusBadRequest)
+			return
+		}
+	}
+	for _, v := range query["kind"] {
+		for _, k := range strings.Split(v, ",") {
+			filter.Kinds = append(filter.Kinds, domain.TransactionKind(strings.TrimSpace(k)))
+		}
+	}
+	if filter.CreatedFrom, err = parseTimeParam(query, "created_from"); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if filter.CreatedTo, err = parseTimeParam(query, "created_to"); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	page, err := h.repo.ListTransactions(filter)
+	if err != nil {
+		if errors.Is(err, repository.ErrAccountNotFound) {
+			http.Error(w, "account not found", http.StatusNotFound)
+			return
+		}
+		http.Error(w, "failed to get transactions: "+err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	_ = json.NewEncoder(w).Encode(page)
+}
+
+// isValidationError reports whether err is about the request rather than a
+// failure of the service. Anything else is answered with 500, which the
+// idempotency middleware does not store, so the client can retry the key.
+func isValidationError(err error) bool {
+	return errors.Is(err, repository.ErrInvalidAmount) || errors.Is(err, repository.ErrSelfTransfer)
+}
+
+func parseTimeParam(query url.Values, name string) (*time.Time, error) {
+	v := query.Get(name)
+	if v == "" {
+		return nil, nil
+	}
+	t, err := time.Parse(time.RFC3339, v)
+	if err != nil {
+		return nil, fmt.Errorf("invalid %s parameter: expected RFC 3339 timestamp", name)
+	}
+	return &t, nil
 }
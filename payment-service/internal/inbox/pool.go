@@ -0,0 +1,51 @@
+package inbox
+
+import (
+	"broker"
+	"shared/events"
+)
+
+// shardedPool handles deliveries on a fixed set of workers. Deliveries with
+// the same key always go to the same worker, so they are handled one at a
+// time and in the order they arrived, while different keys run in parallel.
+// The workers live as long as the process.
+type shardedPool struct {
+	workers []chan broker.Delivery
+}
+
+func newShardedPool(size int, handle func(broker.Delivery)) *shardedPool {
+	p := &shardedPool{workers: make([]chan broker.Delivery, max(size, 1))}
+	for i := range p.workers {
+		work := make(chan broker.Delivery)
+		p.workers[i] = work
+		go func() {
+			for d := range work {
+				handle(d)
+			}
+		}()
+	}
+	return p
+}
+
+// dispatch blocks while the worker owning key is busy, which together with
+// the subscription prefetch bounds how many deliveries are in flight.
+func (p *shardedPool) dispatch(key int64, d broker.Delivery) {
+	shard := uint64(key) % uint64(len(p.workers))
+	p.workers[shard] <- d
+}
+
+// userKey returns the user_id of the event in d. Deliveries that cannot be
+// parsed get key 0; processMessage parks them anyway.
+func userKey(d broker.Delivery) int64 {
+	env, err := events.Parse(d.Body, d.Type, d.ID)
+	if err != nil {
+		return 0
+	}
+	var data struct {
+		UserID int64 `json:"user_id"`
+	}
+	if env.Decode(&data) != nil {
+		return 0
+	}
+	return data.UserID
+}
@@ -0,0 +1,91 @@
+package inbox
+
+import (
+	"broker"
+	"context"
+	"encoding/json"
+	"fmt"
+	"shared/events"
+	"sync"
+	"testing"
+	"time"
+)
+
+// handleCost stands in for the Postgres transaction processMessage runs per
+// payment, so the benchmark measures how the inbox overlaps them without a
+// database.
+const handleCost = time.Millisecond
+
+const benchUsers = 50
+
+// BenchmarkInbox pushes OrderCreated events for benchUsers accounts through
+// broker.Memory, the subscription prefetch and the sharded pool, the same way
+// Start does, and reports the throughput.
+func BenchmarkInbox(b *testing.B) {
+	for _, cfg := range []Config{
+		{Workers: 1, Prefetch: 1},
+		{Workers: 8, Prefetch: 32},
+	} {
+		b.Run(fmt.Sprintf("workers=%d/prefetch=%d", cfg.Workers, cfg.Prefetch), func(b *testing.B) {
+			benchmarkInbox(b, cfg)
+		})
+	}
+}
+
+func benchmarkInbox(b *testing.B, cfg Config) {
+	bus := broker.NewMemory()
+	defer bus.Close()
+	err := bus.Declare(broker.Topology{
+		Exchanges: []broker.Exchange{{Name: "order_events", Kind: broker.Topic}},
+		Queues:    []broker.Queue{{Name: Queue}},
+		Bindings:  []broker.Binding{{Queue: Queue, Exchange: "order_events", RoutingKey: events.RoutingKey("OrderCreated")}},
+	})
+	if err != nil {
+		b.Fatal(err)
+	}
+	msgs := make([]broker.Message, b.N)
+	for i := range msgs {
+		env, err := events.New("OrderCreated", map[string]interface{}{
+			"order_id": i + 1,
+			"user_id":  i%benchUsers + 1,
+			"amount":   100,
+		}, "", "")
+		if err != nil {
+			b.Fatal(err)
+		}
+		body, err := json.Marshal(env)
+		if err != nil {
+			b.Fatal(err)
+		}
+		msgs[i] = broker.Message{
+			Exchange:   "order_events",
+			RoutingKey: events.RoutingKey("OrderCreated"),
+			ID:         env.EventID,
+			Type:       env.EventType,
+			Body:       body,
+		}
+	}
+	for _, err := range bus.Publish(context.Background(), msgs...) {
+		if err != nil {
+			b.Fatal(err)
+		}
+	}
+
+	var done sync.WaitGroup
+	done.Add(b.N)
+	pool := newShardedPool(cfg.Workers, func(d broker.Delivery) {
+		time.Sleep(handleCost)
+		d.Ack()
+		done.Done()
+	})
+	b.ResetTimer()
+	start := time.Now()
+	err = bus.Subscribe(Queue, cfg.Prefetch, func(d broker.Delivery) {
+		pool.dispatch(userKey(d), d)
+	})
+	if err != nil {
+		b.Fatal(err)
+	}
+	done.Wait()
+	b.ReportMetric(float64(b.N)/time.Since(start).Seconds(), "msg/s")
+}
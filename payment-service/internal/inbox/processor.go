@@ -1,89 +1,205 @@
 package inbox
 
 import (
+	"broker"
+	"broker/deadletter"
+	"context"
 	"database/sql"
 	"encoding/json"
+	"errors"
+	"fmt"
 	"log"
 	"payment-service/internal/domain"
+	"payment-service/internal/ledger"
 	"payment-service/internal/repository"
+	"shared/events"
+	"shared/tracing"
+	"time"
 
-	amqp "github.com/rabbitmq/amqp091-go"
+	"go.opentelemetry.io/otel/trace"
 )
 
+// Queue is the queue the processor consumes order events from.
+const Queue = "orders_queue"
+
+type Config struct {
+	// MaxRetries and RetryDelay control how deliveries that fail with a
+	// transient error are retried before being parked.
+	MaxRetries int
+	RetryDelay time.Duration
+	// Prefetch is how many unacked deliveries the broker hands out at once.
+	Prefetch int
+	// Workers is how many deliveries are processed concurrently. Deliveries
+	// are sharded by user_id, so one account is never charged by two
+	// workers at the same time.
+	Workers int
+	// HoldTTL is how long the hold taken for an order stays authorized.
+	HoldTTL time.Duration
+	// AutoCapture captures the hold right after authorizing it, so the
+	// order is charged immediately. Otherwise the hold waits to be captured
+	// or voided through the accounts API.
+	AutoCapture bool
+}
+
 type InboxProcessor struct {
-	db       *sql.DB
-	rabbitCh *amqp.Channel
-	repo     *repository.AccountRepository
+	db          *sql.DB
+	repo        *repository.AccountRepository
+	broker      broker.Broker
+	cfg         Config
+	deadLetters *deadletter.Handler
 }
 
-func NewInboxProcessor(db *sql.DB, conn *amqp.Connection, repo *repository.AccountRepository) (*InboxProcessor, error) {
-	ch, err := conn.Channel()
-	if err != nil {
+// NewInboxProcessor declares orders_queue together with its dead-letter
+// topology on b and creates a processor for it.
+func NewInboxProcessor(db *sql.DB, repo *repository.AccountRepository, b broker.Broker, cfg Config) (*InboxProcessor, error) {
+	if err := b.Declare(deadletter.Topology(Queue)); err != nil {
 		return nil, err
 	}
-	_, err = ch.QueueDeclare(
-		"orders_queue",
-		true,
-		false,
-		false,
-		false,
-		nil,
-	)
+	err := b.Declare(broker.Topology{
+		Exchanges: []broker.Exchange{{Name: "order_events", Kind: broker.Topic}},
+		Queues:    []broker.Queue{{Name: Queue, DeadLetter: deadletter.DeadLetterTarget(Queue)}},
+		Bindings: []broker.Binding{
+			{Queue: Queue, Exchange: "order_events", RoutingKey: events.RoutingKey("OrderCreated")},
+			{Queue: Queue, Exchange: "order_events", RoutingKey: events.RoutingKey("OrderCancelled")},
+		},
+	})
 	if err != nil {
 		return nil, err
 	}
-	return &InboxProcessor{db: db, rabbitCh: ch, repo: repo}, nil
+	return &InboxProcessor{
+		db:          db,
+		repo:        repo,
+		broker:      b,
+		cfg:         cfg,
+		deadLetters: deadletter.NewHandler(b, Queue, cfg.MaxRetries, cfg.RetryDelay),
+	}, nil
 }
 
+// Start starts consuming orders_queue.
 func (processor *InboxProcessor) Start() error {
-	messages, err := processor.rabbitCh.Consume(
-		"orders_queue",
-		"",
-		false,
-		false,
-		false,
-		false,
-		nil,
-	)
+	pool := newShardedPool(processor.cfg.Workers, processor.processMessage)
+	return processor.broker.Subscribe(Queue, processor.cfg.Prefetch, func(message broker.Delivery) {
+		pool.dispatch(userKey(message), message)
+	})
+}
+
+func (processor *InboxProcessor) processMessage(message broker.Delivery) {
+	ctx := tracing.FromHeaders(context.Background(), message.Headers)
+	ctx, span := tracing.Start(ctx, "process "+message.Type, trace.WithSpanKind(trace.SpanKindConsumer))
+	defer span.End()
+	env, err := events.Parse(message.Body, message.Type, message.ID)
+	if err != nil {
+		processor.deadLetters.Park(message, err)
+		return
+	}
+	if env.EventID == "" {
+		// Without an id the message cannot be deduplicated; it can be
+		// replayed from the parking lot once it has one.
+		processor.deadLetters.Park(message, errors.New("message has no id"))
+		return
+	}
+	switch env.EventType {
+	case "OrderCreated":
+		processor.processPayment(ctx, message, env)
+	case "OrderCancelled":
+		processor.processCancellation(ctx, message, env)
+	default:
+		processor.deadLetters.Park(message, fmt.Errorf("unknown event type %q", env.EventType))
+	}
+}
+
+// claimMessage records the incoming event in inbox_messages under its event
+// id. It returns false if the event was already processed; the result recorded
+// for it then is enqueued again, so a redelivery gets the same answer instead
+// of being processed twice.
+func claimMessage(ctx context.Context, tx *sql.Tx, env events.Envelope, body []byte, orderID int64) (bool, error) {
+	res, err := tx.Exec(`
+        INSERT INTO inbox_messages (message_id, type, payload, order_id)
+        VALUES ($1, $2, $3, $4)
+        ON CONFLICT (message_id) DO NOTHING
+    `, env.EventID, env.EventType, body, orderID)
+	if err != nil {
+		return false, fmt.Errorf("insert inbox message: %w", err)
+	}
+	if n, _ := res.RowsAffected(); n == 1 {
+		return true, nil
+	}
+	_, err = tx.Exec(`
+        INSERT INTO outbox_events (type, payload, status, event_id, trace_context)
+        SELECT result->>'event_type', result, 'pending', result->>'event_id', $2
+        FROM inbox_messages
+        WHERE message_id = $1 AND result IS NOT NULL
+    `, env.EventID, tracing.Marshal(ctx))
+	if err != nil {
+		return false, fmt.Errorf("re-enqueue recorded result: %w", err)
+	}
+	return false, nil
+}
+
+// recordResult enqueues a result event caused by the incoming event in and
+// stores it on in's inbox row for claimMessage to replay. The result carries
+// the checkout's correlation id, and the trace of ctx.
+func recordResult(ctx context.Context, tx *sql.Tx, in events.Envelope, eventType string, data interface{}) error {
+	env, err := events.New(eventType, data, in.CorrelationID, in.EventID)
 	if err != nil {
 		return err
 	}
-	go func() {
-		for message := range messages {
-			processor.processMessage(message)
-		}
-	}()
-	return nil
+	payload, err := json.Marshal(env)
+	if err != nil {
+		return fmt.Errorf("marshal %s envelope: %w", eventType, err)
+	}
+	_, err = tx.Exec(`
+        INSERT INTO outbox_events (type, payload, status, event_id, trace_context)
+        VALUES ($1, $2, 'pending', $3, $4)
+    `, eventType, payload, env.EventID, tracing.Marshal(ctx))
+	if err != nil {
+		return err
+	}
+	_, err = tx.Exec(`UPDATE inbox_messages SET result = $1 WHERE message_id = $2`, payload, in.EventID)
+	return err
+}
+
+// retry marks the span of ctx as failed and schedules message for retry.
+func (processor *InboxProcessor) retry(ctx context.Context, message broker.Delivery, err error) {
+	tracing.Fail(trace.SpanFromContext(ctx), err)
+	processor.deadLetters.Retry(message, err)
 }
 
-func (processor *InboxProcessor) processMessage(message amqp.Delivery) {
+func (processor *InboxProcessor) commitAndAck(ctx context.Context, tx *sql.Tx, message broker.Delivery) {
+	if err := tx.Commit(); err != nil {
+		processor.retry(ctx, message, fmt.Errorf("commit tx: %w", err))
+		return
+	}
+	message.Ack()
+}
+
+func (processor *InboxProcessor) processPayment(ctx context.Context, message broker.Delivery, env events.Envelope) {
 	var payload struct {
 		OrderID int64 `json:"order_id"`
 		UserID  int64 `json:"user_id"`
 		Amount  int64 `json:"amount"`
 	}
-	if err := json.Unmarshal(message.Body, &payload); err != nil {
-		log.Printf("Error decoding JSON: %v", err)
-		message.Ack(false)
+	if err := env.Decode(&payload); err != nil {
+		processor.deadLetters.Park(message, err)
 		return
 	}
-	log.Printf("Received payment request: OrderID=%d UserID=%d Amount=%d",
-		payload.OrderID, payload.UserID, payload.Amount)
+	log.Printf("Received payment request: OrderID=%d UserID=%d Amount=%d EventID=%s CorrelationID=%s",
+		payload.OrderID, payload.UserID, payload.Amount, env.EventID, env.CorrelationID)
 	tx, err := processor.db.Begin()
 	if err != nil {
-		log.Printf("DB error (begin tx): %v", err)
-		message.Nack(false, true)
+		processor.retry(ctx, message, fmt.Errorf("begin tx: %w", err))
 		return
 	}
 	defer tx.Rollback()
-	_, err = tx.Exec(`
-        INSERT INTO inbox_messages (message_id, type, payload)
-        VALUES ($1, $2, $3)
-        ON CONFLICT (message_id) DO NOTHING
-    `, payload.OrderID, "PaymentRequest", message.Body)
-
+	fresh, err := claimMessage(ctx, tx, env, message.Body, payload.OrderID)
 	if err != nil {
-		log.Printf("Warning: failed to write to inbox_messages: %v", err)
+		processor.retry(ctx, message, fmt.Errorf("claim message: %w", err))
+		return
+	}
+	if !fresh {
+		log.Printf("Duplicate %s %s, resending recorded result", env.EventType, env.EventID)
+		processor.commitAndAck(ctx, tx, message)
+		return
 	}
 	success := false
 	var accountID int64
@@ -96,34 +212,54 @@ func (processor *InboxProcessor) processMessage(message amqp.Delivery) {
 		log.Printf("User %d not found, payment failed", payload.UserID)
 		success = false
 	} else if err != nil {
-		log.Printf("DB error (select account): %v", err)
-		message.Nack(false, true)
+		processor.retry(ctx, message, fmt.Errorf("select account: %w", err))
 		return
 	} else {
-		if balance >= payload.Amount {
-			_, err = tx.Exec(`
-                UPDATE accounts SET balance = balance - $1 WHERE id = $2
-            `, payload.Amount, accountID)
+		// order-service republishes OrderCreated when the result is late,
+		// so the order may already have been charged: its hold is then
+		// live or captured, and refunded once the money went back. With
+		// several outbox replicas OrderCancelled may also overtake
+		// OrderCreated, and a cancelled order must not be charged at all.
+		var alreadyPaid, cancelled bool
+		err = tx.QueryRow(`
+            SELECT
+                EXISTS (SELECT 1 FROM holds WHERE order_id = $1 AND account_id = $2
+                        AND (status = $3 OR (status = $4 AND expires_at > NOW()))),
+                EXISTS (SELECT 1 FROM inbox_messages WHERE order_id = $1 AND type = 'OrderCancelled')
+        `, payload.OrderID, accountID, domain.HoldStatusCaptured, domain.HoldStatusAuthorized).Scan(&alreadyPaid, &cancelled)
+		if err != nil {
+			processor.retry(ctx, message, fmt.Errorf("select payment: %w", err))
+			return
+		}
+		held, err := ledger.Held(ctx, tx, accountID)
+		if err != nil {
+			processor.retry(ctx, message, err)
+			return
+		}
+		available := balance - held
+		if alreadyPaid {
+			success = true
+			log.Printf("Order %d is already paid, resending result", payload.OrderID)
+		} else if cancelled {
+			success = false
+			log.Printf("Order %d was cancelled before payment", payload.OrderID)
+		} else if available >= payload.Amount {
+			hold, err := ledger.Authorize(ctx, tx, accountID, payload.OrderID, payload.Amount, processor.cfg.HoldTTL)
 			if err != nil {
-				log.Printf("DB error (update balance): %v", err)
-				message.Nack(false, true)
+				processor.retry(ctx, message, fmt.Errorf("authorize payment: %w", err))
 				return
 			}
-			minusAmount := -payload.Amount
-			_, err = tx.Exec(`
-                INSERT INTO account_transactions (account_id, amount)
-                VALUES ($1, $2)
-            `, accountID, minusAmount)
-			if err != nil {
-				log.Printf("DB error (insert transaction): %v", err)
-				message.Nack(false, true)
-				return
+			if processor.cfg.AutoCapture {
+				if _, err := ledger.Capture(ctx, tx, hold.ID); err != nil {
+					processor.retry(ctx, message, fmt.Errorf("capture payment: %w", err))
+					return
+				}
 			}
 			success = true
-			log.Printf("Payment SUCCESS for Order %d", payload.OrderID)
+			log.Printf("Payment SUCCESS for Order %d (hold %d, captured: %t)", payload.OrderID, hold.ID, processor.cfg.AutoCapture)
 		} else {
-			log.Printf("Not enough money for Order %d (Balance: %d, Needed: %d)",
-				payload.OrderID, balance, payload.Amount)
+			log.Printf("Not enough money for Order %d (Available: %d, Needed: %d)",
+				payload.OrderID, available, payload.Amount)
 			success = false
 		}
 	}
@@ -137,29 +273,157 @@ func (processor *InboxProcessor) processMessage(message amqp.Delivery) {
 		resultEventType = "PaymentFailed"
 	}
 	log.Printf("Payment result for Order %d: pay_status=%s event_status=%s", payload.OrderID, payStatus, resultEventType)
-	resultPayload, err := json.Marshal(map[string]interface{}{
+	err = recordResult(ctx, tx, env, resultEventType, map[string]interface{}{
 		"order_id": payload.OrderID,
 		"user_id":  payload.UserID,
 		"status":   resultEventType,
 	})
 	if err != nil {
-		log.Printf("Failed to marshal result payload: %v", err)
-		message.Nack(false, true)
+		processor.retry(ctx, message, fmt.Errorf("insert outbox: %w", err))
 		return
 	}
-	_, err = tx.Exec(`
-        INSERT INTO outbox_events (type, payload, status)
-        VALUES ($1, $2, 'pending')
-    `, resultEventType, resultPayload)
+	if err := tx.Commit(); err != nil {
+		processor.retry(ctx, message, fmt.Errorf("commit tx: %w", err))
+		return
+	}
+	message.Ack()
+}
+
+// processCancellation voids the hold of a cancelled order that was only
+// authorized, and refunds it if it was paid. The refund is posted as a
+// compensating journal entry for the same order, so a redelivered
+// OrderCancelled finds it and does not credit twice.
+func (processor *InboxProcessor) processCancellation(ctx context.Context, message broker.Delivery, env events.Envelope) {
+	var payload struct {
+		OrderID int64 `json:"order_id"`
+		UserID  int64 `json:"user_id"`
+		Amount  int64 `json:"amount"`
+	}
+	if err := env.Decode(&payload); err != nil {
+		processor.deadLetters.Park(message, err)
+		return
+	}
+	log.Printf("Received cancellation: OrderID=%d UserID=%d", payload.OrderID, payload.UserID)
+	tx, err := processor.db.Begin()
+	if err != nil {
+		processor.retry(ctx, message, fmt.Errorf("begin tx: %w", err))
+		return
+	}
+	defer tx.Rollback()
+	// processPayment holds this lock from before it authorizes the hold until
+	// it commits, so taking it first makes the cancellation wait for a
+	// payment in flight and then see its hold.
+	_, err = tx.Exec(`SELECT id FROM accounts WHERE user_id = $1 FOR UPDATE`, payload.UserID)
+	if err != nil {
+		processor.retry(ctx, message, fmt.Errorf("lock account: %w", err))
+		return
+	}
+	fresh, err := claimMessage(ctx, tx, env, message.Body, payload.OrderID)
+	if err != nil {
+		processor.retry(ctx, message, fmt.Errorf("claim message: %w", err))
+		return
+	}
+	if !fresh {
+		log.Printf("Duplicate %s %s, resending recorded result", env.EventType, env.EventID)
+		processor.commitAndAck(ctx, tx, message)
+		return
+	}
+	// An order that was only authorized is released, not refunded: nothing
+	// was charged, so voiding the hold is enough.
+	hold, err := ledger.OrderHold(ctx, tx, payload.OrderID)
+	if err != nil {
+		processor.retry(ctx, message, fmt.Errorf("select hold: %w", err))
+		return
+	}
+	if hold != nil {
+		if _, err := ledger.Void(ctx, tx, hold.ID); err != nil {
+			processor.retry(ctx, message, fmt.Errorf("void hold: %w", err))
+			return
+		}
+		err = recordResult(ctx, tx, env, "PaymentRefunded", map[string]interface{}{
+			"order_id": payload.OrderID,
+			"user_id":  payload.UserID,
+			"amount":   hold.Amount,
+			"status":   "PaymentRefunded",
+			"voided":   true,
+		})
+		if err != nil {
+			processor.retry(ctx, message, fmt.Errorf("insert outbox: %w", err))
+			return
+		}
+		if err := tx.Commit(); err != nil {
+			processor.retry(ctx, message, fmt.Errorf("commit tx: %w", err))
+			return
+		}
+		log.Printf("Voided hold %d of %d for Order %d", hold.ID, hold.Amount, payload.OrderID)
+		message.Ack()
+		return
+	}
+	// The order's postings include the merchant revenue side, so the payer is
+	// the account the payment was taken from.
+	var accountID int64
+	err = tx.QueryRow(`
+        SELECT account_id FROM account_transactions
+        WHERE order_id = $1 AND kind = $2 AND amount < 0
+        LIMIT 1
+    `, payload.OrderID, domain.TransactionKindPayment).Scan(&accountID)
+	if err == sql.ErrNoRows {
+		// Commit anyway: the inbox row is what stops a late OrderCreated
+		// from charging this order.
+		log.Printf("Order %d was not paid, nothing to refund", payload.OrderID)
+		processor.commitAndAck(ctx, tx, message)
+		return
+	} else if err != nil {
+		processor.retry(ctx, message, fmt.Errorf("select payment: %w", err))
+		return
+	}
+	var paid, refunded int64
+	err = tx.QueryRow(`
+        SELECT COALESCE(SUM(-amount) FILTER (WHERE amount < 0), 0),
+               COALESCE(SUM(amount) FILTER (WHERE amount > 0), 0)
+        FROM account_transactions
+        WHERE order_id = $1 AND account_id = $2
+    `, payload.OrderID, accountID).Scan(&paid, &refunded)
+	if err != nil {
+		processor.retry(ctx, message, fmt.Errorf("select payment: %w", err))
+		return
+	}
+	if paid <= refunded {
+		log.Printf("Order %d is already refunded", payload.OrderID)
+		processor.commitAndAck(ctx, tx, message)
+		return
+	}
+	refundAmount := paid - refunded
+	err = ledger.Post(ctx, tx, &ledger.Entry{
+		Kind:    domain.TransactionKindRefund,
+		OrderID: payload.OrderID,
+		Postings: []ledger.Posting{
+			{System: ledger.MerchantRevenue, Amount: -refundAmount},
+			{AccountID: accountID, Amount: refundAmount},
+		},
+	})
+	if err != nil {
+		processor.retry(ctx, message, fmt.Errorf("post refund: %w", err))
+		return
+	}
+	if err := ledger.MarkRefunded(ctx, tx, payload.OrderID); err != nil {
+		processor.retry(ctx, message, err)
+		return
+	}
+	err = recordResult(ctx, tx, env, "PaymentRefunded", map[string]interface{}{
+		"order_id": payload.OrderID,
+		"user_id":  payload.UserID,
+		"amount":   refundAmount,
+		"status":   "PaymentRefunded",
+	})
 	if err != nil {
-		log.Printf("Failed to insert outbox: %v", err)
-		message.Nack(false, true)
+		processor.retry(ctx, message, fmt.Errorf("insert outbox: %w", err))
 		return
 	}
 	if err := tx.Commit(); err != nil {
-		log.Printf("Failed to commit tx: %v", err)
-		message.Nack(false, true)
+		processor.retry(ctx, message, fmt.Errorf("commit tx: %w", err))
 		return
 	}
-	message.Ack(false)
+	log.Printf("Refunded %d for Order %d: pay_status=%s", refundAmount, payload.OrderID, domain.PaymentStatusRefunded)
+	message.Ack()
 }
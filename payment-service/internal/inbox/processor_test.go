@@ -0,0 +1,136 @@
+package inbox_test
+
+import (
+	"broker"
+	"context"
+	"database/sql"
+	"encoding/json"
+	"os"
+	"payment-service/app"
+	"payment-service/internal/domain"
+	"payment-service/internal/inbox"
+	"payment-service/internal/ledger"
+	"payment-service/internal/repository"
+	"shared/events"
+	"testing"
+	"time"
+
+	_ "github.com/lib/pq"
+)
+
+// TestCancellationWaitsForPayment authorizes a hold the way processPayment
+// does, with the account locked and the transaction still open, and delivers
+// OrderCancelled for the same order meanwhile. The cancellation must wait for
+// the payment to commit and then void its hold, instead of finding nothing to
+// release and leaving the hold authorized. Postgres is taken from
+// GOZON_TEST_DB.
+func TestCancellationWaitsForPayment(t *testing.T) {
+	connStr := os.Getenv("GOZON_TEST_DB")
+	if connStr == "" {
+		t.Skip("GOZON_TEST_DB is not set")
+	}
+	db, err := sql.Open("postgres", connStr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	if err := app.Migrate(db); err != nil {
+		t.Fatal(err)
+	}
+	ctx := context.Background()
+	repo := repository.NewAccountRepository(db)
+	// A fresh user and order per run, since the database outlives the test.
+	userID := time.Now().UnixNano()%1_000_000_000 + 2_000_000_000
+	orderID := userID
+	account, err := repo.CreateAccount(userID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := repo.Deposit(ctx, userID, 1000); err != nil {
+		t.Fatal(err)
+	}
+
+	bus := broker.NewMemory()
+	defer bus.Close()
+	processor, err := inbox.NewInboxProcessor(db, repo, bus, inbox.Config{
+		MaxRetries: 3,
+		RetryDelay: 10 * time.Millisecond,
+		Prefetch:   1,
+		Workers:    1,
+		HoldTTL:    time.Minute,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := processor.Start(); err != nil {
+		t.Fatal(err)
+	}
+
+	payment, err := db.Begin()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer payment.Rollback()
+	if _, err := payment.Exec(`SELECT id FROM accounts WHERE user_id = $1 FOR UPDATE`, userID); err != nil {
+		t.Fatal(err)
+	}
+	hold, err := ledger.Authorize(ctx, payment, account.ID, orderID, 100, time.Minute)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	env, err := events.New("OrderCancelled", map[string]interface{}{
+		"order_id": orderID,
+		"user_id":  userID,
+		"amount":   100,
+	}, "", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	body, err := json.Marshal(env)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, err := range bus.Publish(ctx, broker.Message{
+		Exchange:   "order_events",
+		RoutingKey: events.RoutingKey("OrderCancelled"),
+		ID:         env.EventID,
+		Type:       env.EventType,
+		Body:       body,
+	}) {
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// Give the cancellation time to run ahead if it does not wait.
+	time.Sleep(200 * time.Millisecond)
+	if err := payment.Commit(); err != nil {
+		t.Fatal(err)
+	}
+
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		// Read the inbox first: once the cancellation is recorded, the hold
+		// read after it shows what the cancellation did.
+		var handled bool
+		err := db.QueryRow(`SELECT EXISTS (SELECT 1 FROM inbox_messages WHERE message_id = $1)`, env.EventID).Scan(&handled)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var status domain.HoldStatus
+		if err := db.QueryRow(`SELECT status FROM holds WHERE id = $1`, hold.ID).Scan(&status); err != nil {
+			t.Fatal(err)
+		}
+		if status == domain.HoldStatusVoided {
+			return
+		}
+		if handled {
+			t.Fatalf("cancellation of order %d left hold %d %s", orderID, hold.ID, status)
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("order %d was not cancelled, hold %d is %s", orderID, hold.ID, status)
+		}
+		time.Sleep(20 * time.Millisecond)
+	}
+}
@@ -0,0 +1,208 @@
+package ledger
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"payment-service/internal/domain"
+	"time"
+)
+
+// DefaultHoldTTL is how long a hold stays authorized if the caller does not
+// say otherwise.
+const DefaultHoldTTL = 7 * 24 * time.Hour
+
+var (
+	ErrHoldNotFound = errors.New("hold not found")
+	// ErrHoldNotActive means the hold was already captured, voided or has
+	// expired.
+	ErrHoldNotActive = errors.New("hold is not authorized")
+)
+
+const holdColumns = `h.id, h.account_id, a.user_id, h.order_id, h.amount, h.status, h.expires_at, h.created_at`
+
+// Held returns the sum of the account's live holds, which is what the
+// balance exceeds the available amount by.
+func Held(ctx context.Context, tx *sql.Tx, accountID int64) (int64, error) {
+	var held int64
+	err := tx.QueryRowContext(ctx, `
+		SELECT COALESCE(SUM(amount), 0) FROM holds
+		WHERE account_id = $1 AND status = $2 AND expires_at > NOW()`,
+		accountID, domain.HoldStatusAuthorized).Scan(&held)
+	if err != nil {
+		return 0, fmt.Errorf("sum holds: %w", err)
+	}
+	return held, nil
+}
+
+// Authorize puts a hold of amount on the account for ttl. No money moves. The
+// caller must hold the account lock and have checked the available balance.
+// orderID is zero for holds not taken for an order.
+func Authorize(ctx context.Context, tx *sql.Tx, accountID, orderID, amount int64, ttl time.Duration) (*domain.Hold, error) {
+	if amount <= 0 {
+		return nil, fmt.Errorf("amount must be positive: %d", amount)
+	}
+	if ttl <= 0 {
+		return nil, fmt.Errorf("hold ttl must be positive: %s", ttl)
+	}
+	var id int64
+	err := tx.QueryRowContext(ctx, `
+		INSERT INTO holds (account_id, order_id, amount, status, expires_at)
+		VALUES ($1, $2, $3, $4, NOW() + $5::BIGINT * INTERVAL '1 millisecond')
+		RETURNING id`,
+		accountID, nullID(orderID), amount, domain.HoldStatusAuthorized, ttl.Milliseconds()).Scan(&id)
+	if err != nil {
+		return nil, fmt.Errorf("insert hold: %w", err)
+	}
+	return getHold(ctx, tx, id)
+}
+
+// Capture settles an authorized hold: the held amount is posted from the
+// account to merchant revenue as a payment. The caller must hold the account
+// lock.
+func Capture(ctx context.Context, tx *sql.Tx, holdID int64) (*domain.Hold, error) {
+	hold, err := settle(ctx, tx, holdID, domain.HoldStatusCaptured)
+	if err != nil {
+		return nil, err
+	}
+	entry := &Entry{
+		Kind: domain.TransactionKindPayment,
+		Postings: []Posting{
+			{AccountID: hold.AccountID, Amount: -hold.Amount},
+			{System: MerchantRevenue, Amount: hold.Amount},
+		},
+	}
+	if hold.OrderID != nil {
+		entry.OrderID = *hold.OrderID
+	}
+	if err := Post(ctx, tx, entry); err != nil {
+		return nil, err
+	}
+	return hold, nil
+}
+
+// Void releases an authorized hold without moving money.
+func Void(ctx context.Context, tx *sql.Tx, holdID int64) (*domain.Hold, error) {
+	return settle(ctx, tx, holdID, domain.HoldStatusVoided)
+}
+
+// HoldAccountID returns the account a hold is on, so the caller can lock it
+// before capturing.
+func HoldAccountID(ctx context.Context, tx *sql.Tx, holdID int64) (int64, error) {
+	var accountID int64
+	err := tx.QueryRowContext(ctx, `SELECT account_id FROM holds WHERE id = $1`, holdID).Scan(&accountID)
+	if err == sql.ErrNoRows {
+		return 0, ErrHoldNotFound
+	}
+	return accountID, err
+}
+
+// OrderHold returns the live hold taken for an order, or nil if there is
+// none.
+func OrderHold(ctx context.Context, tx *sql.Tx, orderID int64) (*domain.Hold, error) {
+	hold, err := scanHold(tx.QueryRowContext(ctx, `
+		SELECT `+holdColumns+`
+		FROM holds h JOIN accounts a ON a.id = h.account_id
+		WHERE h.order_id = $1 AND h.status = $2 AND h.expires_at > NOW()
+		LIMIT 1`, orderID, domain.HoldStatusAuthorized))
+	if err == ErrHoldNotFound {
+		return nil, nil
+	}
+	return hold, err
+}
+
+// MarkRefunded moves the captured hold of an order to refunded once the
+// order's refund is posted, so the order no longer counts as paid.
+func MarkRefunded(ctx context.Context, tx *sql.Tx, orderID int64) error {
+	_, err := tx.ExecContext(ctx, `
+		UPDATE holds SET status = $2, updated_at = NOW()
+		WHERE order_id = $1 AND status = $3`,
+		orderID, domain.HoldStatusRefunded, domain.HoldStatusCaptured)
+	if err != nil {
+		return fmt.Errorf("mark hold refunded: %w", err)
+	}
+	return nil
+}
+
+// settle moves a live authorized hold to status. The UPDATE takes the row
+// lock, so a hold is captured or voided at most once.
+func settle(ctx context.Context, tx *sql.Tx, holdID int64, status domain.HoldStatus) (*domain.Hold, error) {
+	res, err := tx.ExecContext(ctx, `
+		UPDATE holds SET status = $2, updated_at = NOW()
+		WHERE id = $1 AND status = $3 AND expires_at > NOW()`,
+		holdID, status, domain.HoldStatusAuthorized)
+	if err != nil {
+		return nil, fmt.Errorf("update hold: %w", err)
+	}
+	if n, _ := res.RowsAffected(); n == 0 {
+		if _, err := getHold(ctx, tx, holdID); err != nil {
+			return nil, err
+		}
+		return nil, ErrHoldNotActive
+	}
+	return getHold(ctx, tx, holdID)
+}
+
+func getHold(ctx context.Context, tx *sql.Tx, holdID int64) (*domain.Hold, error) {
+	return scanHold(tx.QueryRowContext(ctx, `
+		SELECT `+holdColumns+`
+		FROM holds h JOIN accounts a ON a.id = h.account_id
+		WHERE h.id = $1`, holdID))
+}
+
+func scanHold(row *sql.Row) (*domain.Hold, error) {
+	hold := &domain.Hold{}
+	var orderID sql.NullInt64
+	err := row.Scan(&hold.ID, &hold.AccountID, &hold.UserID, &orderID, &hold.Amount, &hold.Status, &hold.ExpiresAt, &hold.CreatedAt)
+	if err == sql.ErrNoRows {
+		return nil, ErrHoldNotFound
+	}
+	if err != nil {
+		return nil, fmt.Errorf("get hold: %w", err)
+	}
+	if orderID.Valid {
+		hold.OrderID = &orderID.Int64
+	}
+	return hold, nil
+}
+
+// ExpireHolds marks up to limit authorized holds past their expiry as
+// expired and returns them. Such holds already stopped counting against the
+// available balance when they expired; this keeps their status honest and
+// lets the caller tell whoever is waiting on them.
+func ExpireHolds(ctx context.Context, tx *sql.Tx, limit int) ([]domain.Hold, error) {
+	rows, err := tx.QueryContext(ctx, `
+		WITH expired AS (
+			UPDATE holds SET status = $1, updated_at = NOW()
+			WHERE id IN (
+				SELECT id FROM holds
+				WHERE status = $2 AND expires_at <= NOW()
+				ORDER BY id
+				LIMIT $3
+				FOR UPDATE SKIP LOCKED
+			)
+			RETURNING *
+		)
+		SELECT `+holdColumns+`
+		FROM expired h JOIN accounts a ON a.id = h.account_id
+		ORDER BY h.id`, domain.HoldStatusExpired, domain.HoldStatusAuthorized, limit)
+	if err != nil {
+		return nil, fmt.Errorf("expire holds: %w", err)
+	}
+	defer rows.Close()
+	var holds []domain.Hold
+	for rows.Next() {
+		var hold domain.Hold
+		var orderID sql.NullInt64
+		err := rows.Scan(&hold.ID, &hold.AccountID, &hold.UserID, &orderID, &hold.Amount, &hold.Status, &hold.ExpiresAt, &hold.CreatedAt)
+		if err != nil {
+			return nil, err
+		}
+		if orderID.Valid {
+			hold.OrderID = &orderID.Int64
+		}
+		holds = append(holds, hold)
+	}
+	return holds, rows.Err()
+}
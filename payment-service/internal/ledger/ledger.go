@@ -0,0 +1,212 @@
+// Package ledger keeps account money as a double-entry ledger. Every change
+// is a journal entry whose postings sum to zero, so money only moves between
+// accounts: user accounts, and system accounts standing for the outside world.
+// accounts.balance of a user account is a cache of the sum of its postings,
+// updated together with them and checked by Verify.
+package ledger
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"payment-service/internal/domain"
+)
+
+// System accounts are rows of accounts with a code instead of a user_id.
+// They keep no cached balance, so postings to them do not lock a shared row.
+const (
+	// CashIn is the counterpart of deposits and withdrawals: money that came
+	// into or left the system from outside.
+	CashIn = "cash-in"
+	// MerchantRevenue is the counterpart of order payments and refunds.
+	MerchantRevenue = "merchant-revenue"
+)
+
+// SystemAccounts lists the codes created at startup.
+var SystemAccounts = []string{CashIn, MerchantRevenue}
+
+var ErrUnbalanced = errors.New("journal entry does not balance")
+
+// Posting moves Amount into one account, or out of it if Amount is negative.
+// Exactly one of AccountID (a user account) and System (a system account
+// code) is set.
+type Posting struct {
+	AccountID int64
+	System    string
+	Amount    int64
+
+	// Set by Post.
+	ID           int64
+	BalanceAfter int64
+}
+
+// Entry is one journal entry. OrderID and TransferID are the reference the
+// postings are recorded with, zero if there is none.
+type Entry struct {
+	ID         int64
+	Kind       domain.TransactionKind
+	OrderID    int64
+	TransferID int64
+	Postings   []Posting
+}
+
+// Post records e in tx: a journal_entries row, an account_transactions row
+// per posting and the new cached balance of every user account involved. It
+// fills in the IDs and the balance after each user posting. The caller must
+// already hold the locks on the user accounts and have checked their funds.
+func Post(ctx context.Context, tx *sql.Tx, e *Entry) error {
+	if len(e.Postings) < 2 {
+		return fmt.Errorf("%w: %d postings", ErrUnbalanced, len(e.Postings))
+	}
+	var sum int64
+	for _, p := range e.Postings {
+		if (p.AccountID == 0) == (p.System == "") {
+			return fmt.Errorf("posting must name either a user or a system account")
+		}
+		sum += p.Amount
+	}
+	if sum != 0 {
+		return fmt.Errorf("%w: postings sum to %d", ErrUnbalanced, sum)
+	}
+	err := tx.QueryRowContext(ctx, `
+		INSERT INTO journal_entries (kind) VALUES ($1) RETURNING id`, e.Kind).Scan(&e.ID)
+	if err != nil {
+		return fmt.Errorf("insert journal entry: %w", err)
+	}
+	for i := range e.Postings {
+		p := &e.Postings[i]
+		var balanceAfter sql.NullInt64
+		if p.System != "" {
+			err = tx.QueryRowContext(ctx, `SELECT id FROM accounts WHERE code = $1`, p.System).Scan(&p.AccountID)
+			if err != nil {
+				return fmt.Errorf("system account %s: %w", p.System, err)
+			}
+		} else {
+			err = tx.QueryRowContext(ctx, `
+				UPDATE accounts SET balance = balance + $1 WHERE id = $2
+				RETURNING balance`, p.Amount, p.AccountID).Scan(&p.BalanceAfter)
+			if err != nil {
+				return fmt.Errorf("update balance of account %d: %w", p.AccountID, err)
+			}
+			balanceAfter = sql.NullInt64{Int64: p.BalanceAfter, Valid: true}
+		}
+		err = tx.QueryRowContext(ctx, `
+			INSERT INTO account_transactions (entry_id, account_id, amount, kind, order_id, transfer_id, balance_after)
+			VALUES ($1, $2, $3, $4, $5, $6, $7)
+			RETURNING id`,
+			e.ID, p.AccountID, p.Amount, e.Kind, nullID(e.OrderID), nullID(e.TransferID), balanceAfter,
+		).Scan(&p.ID)
+		if err != nil {
+			return fmt.Errorf("insert posting: %w", err)
+		}
+	}
+	return nil
+}
+
+func nullID(id int64) sql.NullInt64 {
+	return sql.NullInt64{Int64: id, Valid: id != 0}
+}
+
+// Mismatch is a user account whose cached balance differs from the sum of
+// its postings.
+type Mismatch struct {
+	AccountID int64 `json:"account_id"`
+	UserID    int64 `json:"user_id"`
+	Balance   int64 `json:"balance"`
+	Posted    int64 `json:"posted"`
+}
+
+// Report is the result of Verify. Consistent is true if both lists are empty.
+type Report struct {
+	Consistent        bool             `json:"consistent"`
+	UnbalancedEntries []int64          `json:"unbalanced_entries"`
+	Mismatches        []Mismatch       `json:"mismatches"`
+	SystemBalances    map[string]int64 `json:"system_balances"`
+}
+
+// Verify checks that every journal entry sums to zero and every cached
+// balance equals the sum of the account's postings. It reads one snapshot,
+// so it can run next to live traffic.
+func Verify(ctx context.Context, db *sql.DB) (*Report, error) {
+	tx, err := db.BeginTx(ctx, &sql.TxOptions{Isolation: sql.LevelRepeatableRead, ReadOnly: true})
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+	report := &Report{
+		UnbalancedEntries: []int64{},
+		Mismatches:        []Mismatch{},
+		SystemBalances:    make(map[string]int64),
+	}
+
+	rows, err := tx.QueryContext(ctx, `
+		SELECT entry_id FROM account_transactions
+		WHERE entry_id IS NOT NULL
+		GROUP BY entry_id
+		HAVING SUM(amount) <> 0
+		ORDER BY entry_id`)
+	if err != nil {
+		return nil, fmt.Errorf("check entries: %w", err)
+	}
+	for rows.Next() {
+		var id int64
+		if err := rows.Scan(&id); err != nil {
+			rows.Close()
+			return nil, err
+		}
+		report.UnbalancedEntries = append(report.UnbalancedEntries, id)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	rows, err = tx.QueryContext(ctx, `
+		SELECT a.id, a.user_id, a.balance, COALESCE(SUM(t.amount), 0)
+		FROM accounts a
+		LEFT JOIN account_transactions t ON t.account_id = a.id
+		WHERE a.user_id IS NOT NULL
+		GROUP BY a.id
+		HAVING a.balance <> COALESCE(SUM(t.amount), 0)
+		ORDER BY a.id`)
+	if err != nil {
+		return nil, fmt.Errorf("check balances: %w", err)
+	}
+	for rows.Next() {
+		var m Mismatch
+		if err := rows.Scan(&m.AccountID, &m.UserID, &m.Balance, &m.Posted); err != nil {
+			rows.Close()
+			return nil, err
+		}
+		report.Mismatches = append(report.Mismatches, m)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	rows, err = tx.QueryContext(ctx, `
+		SELECT a.code, COALESCE(SUM(t.amount), 0)
+		FROM accounts a
+		LEFT JOIN account_transactions t ON t.account_id = a.id
+		WHERE a.code IS NOT NULL
+		GROUP BY a.code`)
+	if err != nil {
+		return nil, fmt.Errorf("system balances: %w", err)
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var code string
+		var balance int64
+		if err := rows.Scan(&code, &balance); err != nil {
+			return nil, err
+		}
+		report.SystemBalances[code] = balance
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	report.Consistent = len(report.UnbalancedEntries) == 0 && len(report.Mismatches) == 0
+	return report, nil
+}
@@ -0,0 +1,38 @@
+package ledger
+
+import (
+	"context"
+	"errors"
+	"testing"
+)
+
+// TestPostRejectsInvalidEntries covers the checks Post makes before it
+// touches the database, so a nil transaction is enough.
+func TestPostRejectsInvalidEntries(t *testing.T) {
+	tests := []struct {
+		name       string
+		postings   []Posting
+		unbalanced bool
+	}{
+		{"no postings", nil, true},
+		{"one posting", []Posting{{AccountID: 1, Amount: 0}}, true},
+		{"sum is not zero", []Posting{{AccountID: 1, Amount: 100}, {System: CashIn, Amount: -99}}, true},
+		{"three postings not summing to zero", []Posting{
+			{AccountID: 1, Amount: -100},
+			{AccountID: 2, Amount: 60},
+			{System: MerchantRevenue, Amount: 50},
+		}, true},
+		{"neither account", []Posting{{Amount: 100}, {System: CashIn, Amount: -100}}, false},
+		{"both accounts", []Posting{{AccountID: 1, System: CashIn, Amount: 100}, {System: CashIn, Amount: -100}}, false},
+	}
+	for _, tt := range tests {
+		err := Post(context.Background(), nil, &Entry{Postings: tt.postings})
+		if err == nil {
+			t.Errorf("%s: Post accepted the entry", tt.name)
+			continue
+		}
+		if got := errors.Is(err, ErrUnbalanced); got != tt.unbalanced {
+			t.Errorf("%s: got %v, want ErrUnbalanced: %t", tt.name, err, tt.unbalanced)
+		}
+	}
+}
@@ -1,91 +1,254 @@
 package outbox
 
 import (
+	"broker"
+	"context"
 	"database/sql"
+	"errors"
+	"expvar"
 	"log"
+	"shared/events"
+	sharedoutbox "shared/outbox"
+	"shared/tracing"
 	"time"
 
-	amqp "github.com/rabbitmq/amqp091-go"
+	"github.com/lib/pq"
+	"go.opentelemetry.io/otel/trace"
 )
 
+const (
+	// NotifyChannel is the Postgres channel the outbox_events insert trigger notifies.
+	NotifyChannel = "outbox_events_new"
+	batchSize     = 10
+	// ExchangeName is the topic exchange payment results are published to,
+	// with events.RoutingKey of their type as routing key.
+	ExchangeName = "payment_events"
+	// fallbackPollInterval only matters if a notification is lost; normally
+	// results are dispatched as soon as the inbox transaction commits.
+	fallbackPollInterval = 30 * time.Second
+	// minWakeupInterval keeps the loop from spinning on rows that are due but
+	// currently locked by another replica.
+	minWakeupInterval = 200 * time.Millisecond
+	// reconnectPollInterval is how often the loop checks whether the broker
+	// is back while it is unreachable.
+	reconnectPollInterval = time.Second
+)
+
+// notifications are events published only for whoever listens right now.
+// No durable queue is bound to them, so an unroutable publish just means
+// nobody is listening and is not retried.
+var notifications = map[string]bool{
+	// Only the gateways' exclusive queues receive transfers, so with no
+	// gateway connected there is nobody to push it to.
+	"TransferCompleted": true,
+}
+
 type OutboxProcessor struct {
-	db       *sql.DB
-	rabbitCh *amqp.Channel
+	db        *sql.DB
+	publisher broker.Publisher
+	listener  *pq.Listener
+	latency   *sharedoutbox.LatencyStats
+	// disconnected is set when the last batch found the broker unreachable,
+	// so the loop polls for it to come back instead of sleeping long.
+	disconnected bool
 }
 
-func NewOutboxProcessor(db *sql.DB, conn *amqp.Connection) (*OutboxProcessor, error) {
-	ch, err := conn.Channel()
+// NewOutboxProcessor declares payment_events on b and creates a
+// processor that wakes up on notifications delivered to listener, which must
+// already LISTEN on NotifyChannel.
+func NewOutboxProcessor(db *sql.DB, b broker.Broker, listener *pq.Listener) (*OutboxProcessor, error) {
+	err := b.Declare(broker.Topology{
+		Exchanges: []broker.Exchange{{Name: ExchangeName, Kind: broker.Topic}},
+	})
 	if err != nil {
 		return nil, err
 	}
-
-	err = ch.ExchangeDeclare(
-		"payment_events_fanout",
-		"fanout",
-		true,
-		false,
-		false,
-		false,
-		nil,
-	)
-	if err != nil {
-		return nil, err
+	latency := &sharedoutbox.LatencyStats{}
+	// expvar names are per process; the end-to-end test runs both services'
+	// outboxes in one, and only the first one's latency is exported there.
+	if expvar.Get("outbox_dispatch_latency") == nil {
+		expvar.Publish("outbox_dispatch_latency", latency)
 	}
-	return &OutboxProcessor{db: db, rabbitCh: ch}, nil
+	return &OutboxProcessor{db: db, publisher: b, listener: listener, latency: latency}, nil
 }
 
 func (processor *OutboxProcessor) Start() {
 	go func() {
-		ticker := time.NewTicker(2 * time.Second)
-		for range ticker.C {
-			processor.processEvents()
+		timer := time.NewTimer(0)
+		for {
+			select {
+			case <-processor.listener.Notify:
+				// A nil notification means the listener reconnected and
+				// may have missed some, which drain handles the same way.
+			case <-timer.C:
+			}
+			processor.drain()
+			timer.Reset(processor.nextWakeup())
 		}
 	}()
 }
 
-func (processor *OutboxProcessor) processEvents() {
-	rows, err := processor.db.Query(`
-		SELECT id, type, payload FROM outbox_events
+// nextWakeup returns how long to sleep until the earliest retry is due, so
+// backed-off rows are retried on time without waiting for the fallback poll.
+func (processor *OutboxProcessor) nextWakeup() time.Duration {
+	if processor.disconnected {
+		return reconnectPollInterval
+	}
+	var seconds sql.NullFloat64
+	err := processor.db.QueryRow(`
+		SELECT EXTRACT(EPOCH FROM (MIN(next_attempt_at) - NOW()))
+		FROM outbox_events
 		WHERE status = 'pending'
-		LIMIT 10
-	`)
+	`).Scan(&seconds)
+	if err != nil || !seconds.Valid {
+		return fallbackPollInterval
+	}
+	return min(max(time.Duration(seconds.Float64*float64(time.Second)), minWakeupInterval), fallbackPollInterval)
+}
+
+// drain publishes batches until outbox_events has no more pending rows or a
+// batch could not be published completely.
+func (processor *OutboxProcessor) drain() {
+	for processor.processEvents() == batchSize {
+	}
+}
+
+type outboxEvent struct {
+	id            int64
+	eventID       string
+	eventType     string
+	correlationID string
+	payload       []byte
+	traceContext  []byte
+	attempts      int
+}
+
+// processEvents claims a batch of due pending rows with FOR UPDATE SKIP LOCKED
+// and holds the lock until they are published and marked processed, so
+// replicas of payment-service never publish the same row twice. A crash rolls
+// the batch back and it is published again, keeping delivery at-least-once.
+// Rows that fail are pushed back with a backoff instead of blocking the batch.
+func (processor *OutboxProcessor) processEvents() int {
+	tx, err := processor.db.Begin()
+	if err != nil {
+		log.Printf("payments outbox: begin tx error: %v", err)
+		return 0
+	}
+	defer tx.Rollback()
+	rows, err := tx.Query(`
+		SELECT id, COALESCE(event_id, id::TEXT), type, COALESCE(payload->>'correlation_id', ''), payload,
+		       COALESCE(trace_context, '{}'), attempts
+		FROM outbox_events
+		WHERE status = 'pending' AND next_attempt_at <= NOW()
+		ORDER BY id
+		LIMIT $1
+		FOR UPDATE SKIP LOCKED
+	`, batchSize)
 	if err != nil {
 		log.Printf("payments outbox: query error: %v", err)
-		return
+		return 0
 	}
-	defer rows.Close()
+	var events []outboxEvent
 	for rows.Next() {
-		var id int64
-		var eventType string
-		var payload []byte
-		if err := rows.Scan(&id, &eventType, &payload); err != nil {
+		var e outboxEvent
+		if err := rows.Scan(&e.id, &e.eventID, &e.eventType, &e.correlationID, &e.payload, &e.traceContext, &e.attempts); err != nil {
 			log.Printf("payments outbox: row scan error: %v", err)
 			continue
 		}
-		err = processor.rabbitCh.Publish(
-			"payment_events_fanout",
-			"",
-			false,
-			false,
-			amqp.Publishing{
-				ContentType: "application/json",
-				Body:        payload,
-				Type:        eventType,
-			},
-		)
-		if err != nil {
-			log.Printf("payments outbox: publish error for id = %d: %v", id, err)
+		events = append(events, e)
+	}
+	rows.Close()
+	published := 0
+	processor.disconnected = false
+	msgs, spans := toMessages(events)
+	for i, publishErr := range processor.publisher.Publish(context.Background(), msgs...) {
+		e := events[i]
+		if errors.Is(publishErr, broker.ErrUnroutable) && notifications[e.eventType] {
+			log.Printf("payments outbox: event %d (%s) has no subscribers, dropping it", e.id, e.eventType)
+			publishErr = nil
+		}
+		if publishErr != nil {
+			tracing.Fail(spans[i], publishErr)
+		}
+		spans[i].End()
+		if errors.Is(publishErr, broker.ErrNotConnected) {
+			// Leave the row alone while the broker is unreachable instead
+			// of burning its attempts.
+			processor.disconnected = true
 			continue
 		}
-		_, err = processor.db.Exec(`
+		if publishErr != nil {
+			if err := processor.recordFailure(tx, e, publishErr); err != nil {
+				log.Printf("payments outbox: record failure error for id=%d: %v", e.id, err)
+				return 0
+			}
+			continue
+		}
+		var waitedSeconds float64
+		err = tx.QueryRow(`
 			UPDATE outbox_events
-			SET status = 'processed'
+			SET status = 'processed', processed_at = clock_timestamp()
 			WHERE id = $1
-		`, id)
+			RETURNING EXTRACT(EPOCH FROM (clock_timestamp() - created_at))
+		`, e.id).Scan(&waitedSeconds)
 		if err != nil {
-			log.Printf("payments outbox: update status error for id=%d: %v", id, err)
-			continue
+			log.Printf("payments outbox: update status error for id=%d: %v", e.id, err)
+			return 0
+		}
+		waited := time.Duration(waitedSeconds * float64(time.Second))
+		processor.latency.Observe(waited)
+		published++
+		log.Printf("payments outbox: event %d (%s %s) confirmed after %s", e.id, e.eventType, e.eventID, waited)
+	}
+	if err := tx.Commit(); err != nil {
+		log.Printf("payments outbox: commit error: %v", err)
+		return 0
+	}
+	return published
+}
+
+// recordFailure bumps the attempt counter of e and schedules the next try,
+// or moves the row to failed once MaxAttempts is reached.
+func (processor *OutboxProcessor) recordFailure(tx *sql.Tx, e outboxEvent, cause error) error {
+	attempts := e.attempts + 1
+	status := "pending"
+	if attempts >= sharedoutbox.MaxAttempts {
+		status = "failed"
+	}
+	delay := sharedoutbox.Backoff(attempts)
+	_, err := tx.Exec(`
+		UPDATE outbox_events
+		SET attempts = $1, last_error = $2, status = $3, next_attempt_at = NOW() + make_interval(secs => $4)
+		WHERE id = $5
+	`, attempts, cause.Error(), status, delay.Seconds(), e.id)
+	if err != nil {
+		return err
+	}
+	if status == "failed" {
+		log.Printf("payments outbox: event %d failed after %d attempts: %v", e.id, attempts, cause)
+	} else {
+		log.Printf("payments outbox: event %d attempt %d failed, retrying in %s: %v", e.id, attempts, delay.Round(time.Millisecond), cause)
+	}
+	return nil
+}
+
+// toMessages turns batch into messages, each with a producer span that
+// continues the trace stored with its row and is carried in the headers.
+func toMessages(batch []outboxEvent) ([]broker.Message, []trace.Span) {
+	msgs := make([]broker.Message, len(batch))
+	spans := make([]trace.Span, len(batch))
+	for i, e := range batch {
+		ctx := tracing.Unmarshal(context.Background(), e.traceContext)
+		ctx, spans[i] = tracing.Start(ctx, "publish "+e.eventType, trace.WithSpanKind(trace.SpanKindProducer))
+		msgs[i] = broker.Message{
+			Exchange:      ExchangeName,
+			RoutingKey:    events.RoutingKey(e.eventType),
+			ID:            e.eventID,
+			Type:          e.eventType,
+			CorrelationID: e.correlationID,
+			Headers:       tracing.Headers(ctx),
+			Body:          e.payload,
 		}
-		log.Printf("payments outbox: event %d (%s) sent successfully", id, eventType)
 	}
+	return msgs, spans
 }
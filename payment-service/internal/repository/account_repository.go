@@ -1,14 +1,29 @@
 package repository
 
 import (
+	"context"
 	"database/sql"
+	"encoding/json"
 	"errors"
 	"fmt"
 	"payment-service/internal/domain"
+	"payment-service/internal/ledger"
+	"shared/events"
+	"shared/tracing"
 	"time"
+
+	"github.com/lib/pq"
 )
 
-var ErrAccountNotFound = errors.New("account not found")
+var (
+	ErrAccountNotFound   = errors.New("account not found")
+	ErrInsufficientFunds = errors.New("insufficient funds")
+	ErrSelfTransfer      = errors.New("can not transfer to the same account")
+	// ErrInvalidAmount wraps amounts the operation does not accept.
+	ErrInvalidAmount = errors.New("invalid amount")
+	// ErrOrderHold means a hold taken for an order was to be voided directly.
+	ErrOrderHold = errors.New("hold belongs to an order, cancel the order instead")
+)
 
 type AccountRepository struct {
 	db *sql.DB
@@ -47,9 +62,51 @@ func (r *AccountRepository) GetAccountByUserID(userID int64) (*domain.Account, e
 	return acc, nil
 }
 
-func (r *AccountRepository) Deposit(userID int64, amount int64) (*domain.Account, error) {
-	if amount < 0 {
-		return nil, fmt.Errorf("amount can not be negative: %d", amount)
+// Deposit credits amount to the user's account from the cash-in system
+// account.
+func (r *AccountRepository) Deposit(ctx context.Context, userID int64, amount int64) (*domain.Account, error) {
+	if amount <= 0 {
+		return nil, fmt.Errorf("%w: must be positive: %d", ErrInvalidAmount, amount)
+	}
+	tx, err := r.db.Begin()
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+	acc := &domain.Account{UserID: userID}
+	err = tx.QueryRow(`SELECT id, created_at FROM accounts 
+                   WHERE user_id = $1 FOR UPDATE`, userID).Scan(&acc.ID, &acc.CreatedAt)
+	if err != nil {
+		if err == sql.ErrNoRows {
+			return nil, ErrAccountNotFound
+		}
+		return nil, err
+	}
+	entry := &ledger.Entry{
+		Kind: domain.TransactionKindDeposit,
+		Postings: []ledger.Posting{
+			{AccountID: acc.ID, Amount: amount},
+			{System: ledger.CashIn, Amount: -amount},
+		},
+	}
+	if err = ledger.Post(ctx, tx, entry); err != nil {
+		return nil, err
+	}
+	if err = tx.Commit(); err != nil {
+		return nil, err
+	}
+	acc.Balance = entry.Postings[0].BalanceAfter
+	return acc, nil
+}
+
+// Withdraw moves amount from the user's account to the cash-in system account
+// and enqueues AccountWithdrawn.
+// The account row is locked like in Deposit, so a concurrent payment cannot
+// spend the same money; ErrInsufficientFunds is returned if the amount is
+// more than the balance not reserved by holds.
+func (r *AccountRepository) Withdraw(ctx context.Context, userID int64, amount int64) (*domain.Account, error) {
+	if amount <= 0 {
+		return nil, fmt.Errorf("%w: must be positive: %d", ErrInvalidAmount, amount)
 	}
 	tx, err := r.db.Begin()
 	if err != nil {
@@ -58,24 +115,39 @@ func (r *AccountRepository) Deposit(userID int64, amount int64) (*domain.Account
 	defer tx.Rollback()
 	var accountID int64
 	var accountBalance int64
-	err = tx.QueryRow(`SELECT id, balance FROM accounts 
-                   WHERE user_id = $1 FOR UPDATE`, userID).Scan(&accountID, &accountBalance)
+	var createdAt time.Time
+	err = tx.QueryRow(`SELECT id, balance, created_at FROM accounts
+                   WHERE user_id = $1 FOR UPDATE`, userID).Scan(&accountID, &accountBalance, &createdAt)
 	if err != nil {
 		if err == sql.ErrNoRows {
 			return nil, ErrAccountNotFound
 		}
 		return nil, err
 	}
-	newBalance := amount + accountBalance
-	_, err = tx.Exec(`
-		UPDATE accounts SET balance = $1 WHERE id = $2`, newBalance, accountID)
+	held, err := ledger.Held(ctx, tx, accountID)
 	if err != nil {
 		return nil, err
 	}
-
-	_, err = tx.Exec(`
-		INSERT INTO account_transactions (account_id, amount)
-		VALUES ($1, $2)`, accountID, amount)
+	if accountBalance-held < amount {
+		return nil, fmt.Errorf("%w: available %d, requested %d", ErrInsufficientFunds, accountBalance-held, amount)
+	}
+	entry := &ledger.Entry{
+		Kind: domain.TransactionKindWithdrawal,
+		Postings: []ledger.Posting{
+			{AccountID: accountID, Amount: -amount},
+			{System: ledger.CashIn, Amount: amount},
+		},
+	}
+	if err = ledger.Post(ctx, tx, entry); err != nil {
+		return nil, err
+	}
+	newBalance := entry.Postings[0].BalanceAfter
+	err = enqueueEvent(ctx, tx, "AccountWithdrawn", map[string]interface{}{
+		"user_id":        userID,
+		"amount":         amount,
+		"balance":        newBalance,
+		"transaction_id": entry.Postings[0].ID,
+	})
 	if err != nil {
 		return nil, err
 	}
@@ -86,6 +158,350 @@ func (r *AccountRepository) Deposit(userID int64, amount int64) (*domain.Account
 		ID:        accountID,
 		UserID:    userID,
 		Balance:   newBalance,
-		CreatedAt: time.Now(),
+		CreatedAt: createdAt,
 	}, nil
 }
+
+// GetBalance returns the user's balance and the part of it not reserved by
+// holds.
+func (r *AccountRepository) GetBalance(userID int64) (*domain.Balance, error) {
+	b := &domain.Balance{UserID: userID}
+	err := r.db.QueryRow(`
+		SELECT a.balance, a.balance - COALESCE(SUM(h.amount), 0)
+		FROM accounts a
+		LEFT JOIN holds h ON h.account_id = a.id AND h.status = $2 AND h.expires_at > NOW()
+		WHERE a.user_id = $1
+		GROUP BY a.id`, userID, domain.HoldStatusAuthorized).Scan(&b.Balance, &b.Available)
+	if err != nil {
+		if err == sql.ErrNoRows {
+			return nil, ErrAccountNotFound
+		}
+		return nil, fmt.Errorf("get balance error: %w", err)
+	}
+	return b, nil
+}
+
+// AuthorizeHold reserves amount of the user's available balance for ttl.
+func (r *AccountRepository) AuthorizeHold(ctx context.Context, userID, amount int64, ttl time.Duration) (*domain.Hold, error) {
+	if amount <= 0 {
+		return nil, fmt.Errorf("%w: must be positive: %d", ErrInvalidAmount, amount)
+	}
+	tx, err := r.db.Begin()
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+	var accountID, balance int64
+	err = tx.QueryRow(`SELECT id, balance FROM accounts
+                   WHERE user_id = $1 FOR UPDATE`, userID).Scan(&accountID, &balance)
+	if err != nil {
+		if err == sql.ErrNoRows {
+			return nil, ErrAccountNotFound
+		}
+		return nil, err
+	}
+	held, err := ledger.Held(ctx, tx, accountID)
+	if err != nil {
+		return nil, err
+	}
+	if balance-held < amount {
+		return nil, fmt.Errorf("%w: available %d, requested %d", ErrInsufficientFunds, balance-held, amount)
+	}
+	hold, err := ledger.Authorize(ctx, tx, accountID, 0, amount, ttl)
+	if err != nil {
+		return nil, err
+	}
+	if err = tx.Commit(); err != nil {
+		return nil, err
+	}
+	return hold, nil
+}
+
+// CaptureHold settles a hold, charging the held amount. The account is
+// locked first, like every other balance change.
+func (r *AccountRepository) CaptureHold(ctx context.Context, holdID int64) (*domain.Hold, error) {
+	tx, err := r.db.Begin()
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+	accountID, err := ledger.HoldAccountID(ctx, tx, holdID)
+	if err != nil {
+		return nil, err
+	}
+	if _, err = tx.Exec(`SELECT id FROM accounts WHERE id = $1 FOR UPDATE`, accountID); err != nil {
+		return nil, err
+	}
+	hold, err := ledger.Capture(ctx, tx, holdID)
+	if err != nil {
+		return nil, err
+	}
+	if err = tx.Commit(); err != nil {
+		return nil, err
+	}
+	return hold, nil
+}
+
+// VoidHold releases a hold without charging it. Holds taken for an order are
+// released by cancelling the order, so order-service learns about it, and are
+// rejected with ErrOrderHold. The account is locked like in CaptureHold,
+// since voiding changes its available balance.
+func (r *AccountRepository) VoidHold(ctx context.Context, holdID int64) (*domain.Hold, error) {
+	tx, err := r.db.Begin()
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+	accountID, err := ledger.HoldAccountID(ctx, tx, holdID)
+	if err != nil {
+		return nil, err
+	}
+	if _, err = tx.Exec(`SELECT id FROM accounts WHERE id = $1 FOR UPDATE`, accountID); err != nil {
+		return nil, err
+	}
+	var orderID sql.NullInt64
+	if err = tx.QueryRow(`SELECT order_id FROM holds WHERE id = $1`, holdID).Scan(&orderID); err != nil {
+		return nil, err
+	}
+	if orderID.Valid {
+		return nil, fmt.Errorf("%w: order %d", ErrOrderHold, orderID.Int64)
+	}
+	hold, err := ledger.Void(ctx, tx, holdID)
+	if err != nil {
+		return nil, err
+	}
+	if err = tx.Commit(); err != nil {
+		return nil, err
+	}
+	return hold, nil
+}
+
+// ExpireHolds expires up to limit overdue holds and enqueues PaymentExpired
+// for those taken for an order, in the checkout's correlation, so
+// order-service stops treating the order as paid. It returns how many holds
+// expired.
+func (r *AccountRepository) ExpireHolds(ctx context.Context, limit int) (int, error) {
+	tx, err := r.db.Begin()
+	if err != nil {
+		return 0, err
+	}
+	defer tx.Rollback()
+	holds, err := ledger.ExpireHolds(ctx, tx, limit)
+	if err != nil {
+		return 0, err
+	}
+	for _, hold := range holds {
+		if hold.OrderID == nil {
+			continue
+		}
+		// A republished OrderCreated has a new event id, so the correlation
+		// id is read from the envelope; the first event id is the fallback.
+		var correlationID string
+		err := tx.QueryRow(`
+			SELECT COALESCE(payload->>'correlation_id', message_id) FROM inbox_messages
+			WHERE order_id = $1 AND type = 'OrderCreated'
+			ORDER BY id
+			LIMIT 1`, *hold.OrderID).Scan(&correlationID)
+		if err != nil && err != sql.ErrNoRows {
+			return 0, fmt.Errorf("select order correlation: %w", err)
+		}
+		err = enqueueCorrelated(ctx, tx, "PaymentExpired", map[string]interface{}{
+			"order_id": *hold.OrderID,
+			"user_id":  hold.UserID,
+			"amount":   hold.Amount,
+			"hold_id":  hold.ID,
+			"status":   "PaymentExpired",
+		}, correlationID)
+		if err != nil {
+			return 0, err
+		}
+	}
+	if err = tx.Commit(); err != nil {
+		return 0, err
+	}
+	return len(holds), nil
+}
+
+// Transfer moves amount from one user's account to another's in a single
+// transaction and enqueues TransferCompleted. Both account rows are locked in
+// one statement in id order, so crossing transfers cannot deadlock with each
+// other, and the inbox, which locks a single account, can only wait behind
+// them. The transfer is recorded in transfers and as a journal entry whose
+// postings point at it.
+func (r *AccountRepository) Transfer(ctx context.Context, fromUserID, toUserID, amount int64) (*domain.Transfer, error) {
+	if amount <= 0 {
+		return nil, fmt.Errorf("%w: must be positive: %d", ErrInvalidAmount, amount)
+	}
+	if fromUserID == toUserID {
+		return nil, ErrSelfTransfer
+	}
+	tx, err := r.db.Begin()
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+	rows, err := tx.Query(`
+		SELECT id, user_id, balance FROM accounts
+		WHERE user_id IN ($1, $2)
+		ORDER BY id
+		FOR UPDATE`, fromUserID, toUserID)
+	if err != nil {
+		return nil, fmt.Errorf("lock accounts error: %w", err)
+	}
+	var from, to *domain.Account
+	for rows.Next() {
+		acc := &domain.Account{}
+		if err := rows.Scan(&acc.ID, &acc.UserID, &acc.Balance); err != nil {
+			rows.Close()
+			return nil, err
+		}
+		if acc.UserID == fromUserID {
+			from = acc
+		} else {
+			to = acc
+		}
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	if from == nil || to == nil {
+		return nil, ErrAccountNotFound
+	}
+	held, err := ledger.Held(ctx, tx, from.ID)
+	if err != nil {
+		return nil, err
+	}
+	if from.Balance-held < amount {
+		return nil, fmt.Errorf("%w: available %d, requested %d", ErrInsufficientFunds, from.Balance-held, amount)
+	}
+	t := &domain.Transfer{FromUserID: fromUserID, ToUserID: toUserID, Amount: amount}
+	err = tx.QueryRow(`
+		INSERT INTO transfers (from_account_id, to_account_id, amount)
+		VALUES ($1, $2, $3)
+		RETURNING id, created_at`, from.ID, to.ID, amount).Scan(&t.ID, &t.CreatedAt)
+	if err != nil {
+		return nil, fmt.Errorf("insert transfer error: %w", err)
+	}
+	err = ledger.Post(ctx, tx, &ledger.Entry{
+		Kind:       domain.TransactionKindTransfer,
+		TransferID: t.ID,
+		Postings: []ledger.Posting{
+			{AccountID: from.ID, Amount: -amount},
+			{AccountID: to.ID, Amount: amount},
+		},
+	})
+	if err != nil {
+		return nil, err
+	}
+	err = enqueueEvent(ctx, tx, "TransferCompleted", map[string]interface{}{
+		"transfer_id":  t.ID,
+		"from_user_id": fromUserID,
+		"to_user_id":   toUserID,
+		"amount":       amount,
+		"status":       "TransferCompleted",
+	})
+	if err != nil {
+		return nil, err
+	}
+	if err = tx.Commit(); err != nil {
+		return nil, err
+	}
+	return t, nil
+}
+
+// ListTransactions returns one page of a user's account history, newest
+// first, using keyset pagination on (created_at, id) like the order list.
+func (r *AccountRepository) ListTransactions(filter TransactionFilter) (*TransactionPage, error) {
+	if filter.Limit <= 0 || filter.Limit > MaxTransactionsPageSize {
+		filter.Limit = DefaultTransactionsPageSize
+	}
+	acc, err := r.GetAccountByUserID(filter.UserID)
+	if err != nil {
+		return nil, err
+	}
+	query := `SELECT id, kind, amount, balance_after, order_id, transfer_id, created_at
+				FROM account_transactions
+				WHERE account_id = $1`
+	args := []interface{}{acc.ID}
+	arg := func(v interface{}) string {
+		args = append(args, v)
+		return fmt.Sprintf("$%d", len(args))
+	}
+	if len(filter.Kinds) > 0 {
+		kinds := make([]string, 0, len(filter.Kinds))
+		for _, k := range filter.Kinds {
+			kinds = append(kinds, string(k))
+		}
+		query += ` AND kind = ANY(` + arg(pq.Array(kinds)) + `)`
+	}
+	if filter.CreatedFrom != nil {
+		query += ` AND created_at >= ` + arg(*filter.CreatedFrom)
+	}
+	if filter.CreatedTo != nil {
+		query += ` AND created_at < ` + arg(*filter.CreatedTo)
+	}
+	if filter.After != nil {
+		query += ` AND (created_at, id) < (` + arg(filter.After.CreatedAt) + `, ` + arg(filter.After.ID) + `)`
+	}
+	query += ` ORDER BY created_at DESC, id DESC LIMIT ` + arg(filter.Limit+1)
+
+	rows, err := r.db.Query(query, args...)
+	if err != nil {
+		return nil, fmt.Errorf("list transactions error: %w", err)
+	}
+	defer rows.Close()
+	transactions := []domain.Transaction{}
+	for rows.Next() {
+		var t domain.Transaction
+		var orderID, transferID sql.NullInt64
+		err := rows.Scan(&t.ID, &t.Kind, &t.Amount, &t.BalanceAfter, &orderID, &transferID, &t.CreatedAt)
+		if err != nil {
+			return nil, err
+		}
+		if orderID.Valid {
+			t.OrderID = &orderID.Int64
+		}
+		if transferID.Valid {
+			t.TransferID = &transferID.Int64
+		}
+		transactions = append(transactions, t)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	page := &TransactionPage{Transactions: transactions}
+	if len(transactions) > filter.Limit {
+		page.Transactions = transactions[:filter.Limit]
+		last := page.Transactions[len(page.Transactions)-1]
+		page.NextCursor = TransactionCursor{CreatedAt: last.CreatedAt, ID: last.ID}.Encode()
+	}
+	return page, nil
+}
+
+// enqueueEvent adds an event that starts a new correlation to outbox_events
+// inside tx, together with the trace context of ctx.
+func enqueueEvent(ctx context.Context, tx *sql.Tx, eventType string, data interface{}) error {
+	return enqueueCorrelated(ctx, tx, eventType, data, "")
+}
+
+// enqueueCorrelated is enqueueEvent for an event that continues the
+// correlation correlationID and is caused by the event with that id. An empty
+// correlationID starts a new one.
+func enqueueCorrelated(ctx context.Context, tx *sql.Tx, eventType string, data interface{}, correlationID string) error {
+	env, err := events.New(eventType, data, correlationID, correlationID)
+	if err != nil {
+		return err
+	}
+	payload, err := json.Marshal(env)
+	if err != nil {
+		return fmt.Errorf("marshal %s envelope: %w", eventType, err)
+	}
+	_, err = tx.Exec(`
+		INSERT INTO outbox_events (type, payload, status, event_id, trace_context)
+		VALUES ($1, $2, 'pending', $3, $4)`, eventType, payload, env.EventID, tracing.Marshal(ctx))
+	if err != nil {
+		return fmt.Errorf("insert outbox: %w", err)
+	}
+	return nil
+}
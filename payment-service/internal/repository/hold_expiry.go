@@ -0,0 +1,46 @@
+package repository
+
+import (
+	"context"
+	"log"
+	"time"
+)
+
+// HoldExpiryJob periodically expires holds that were neither captured nor
+// voided in time.
+type HoldExpiryJob struct {
+	repo      *AccountRepository
+	interval  time.Duration
+	batchSize int
+}
+
+func NewHoldExpiryJob(repo *AccountRepository, interval time.Duration, batchSize int) *HoldExpiryJob {
+	return &HoldExpiryJob{repo: repo, interval: interval, batchSize: batchSize}
+}
+
+func (j *HoldExpiryJob) Start() {
+	go func() {
+		ticker := time.NewTicker(j.interval)
+		for range ticker.C {
+			j.run()
+		}
+	}()
+}
+
+func (j *HoldExpiryJob) run() {
+	total := 0
+	for {
+		n, err := j.repo.ExpireHolds(context.Background(), j.batchSize)
+		if err != nil {
+			log.Printf("hold expiry: %v", err)
+			break
+		}
+		total += n
+		if n < j.batchSize {
+			break
+		}
+	}
+	if total > 0 {
+		log.Printf("hold expiry: expired %d holds", total)
+	}
+}
@@ -0,0 +1,66 @@
+package repository
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"payment-service/internal/domain"
+)
+
+var ErrOutboxEventNotFound = errors.New("failed outbox event not found")
+
+// OutboxRepository gives operators access to outbox rows that exhausted
+// their publish attempts.
+type OutboxRepository struct {
+	db *sql.DB
+}
+
+func NewOutboxRepository(db *sql.DB) *OutboxRepository {
+	return &OutboxRepository{db: db}
+}
+
+func (r *OutboxRepository) ListFailed(limit int) ([]domain.OutboxEvent, error) {
+	rows, err := r.db.Query(`
+		SELECT id, type, payload, status, attempts, last_error, next_attempt_at, created_at
+		FROM outbox_events
+		WHERE status = 'failed'
+		ORDER BY id
+		LIMIT $1`, limit)
+	if err != nil {
+		return nil, fmt.Errorf("list failed outbox events error: %w", err)
+	}
+	defer rows.Close()
+	events := []domain.OutboxEvent{}
+	for rows.Next() {
+		var e domain.OutboxEvent
+		if err := rows.Scan(&e.ID, &e.Type, &e.Payload, &e.Status, &e.Attempts, &e.LastError, &e.NextAttemptAt, &e.CreatedAt); err != nil {
+			return nil, err
+		}
+		events = append(events, e)
+	}
+	return events, rows.Err()
+}
+
+// Requeue resets a failed row so the outbox processor publishes it again
+// with a fresh attempt budget, and wakes the processor up.
+func (r *OutboxRepository) Requeue(id int64) error {
+	tx, err := r.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	res, err := tx.Exec(`
+		UPDATE outbox_events
+		SET status = 'pending', attempts = 0, last_error = NULL, next_attempt_at = NOW()
+		WHERE id = $1 AND status = 'failed'`, id)
+	if err != nil {
+		return fmt.Errorf("requeue outbox event error: %w", err)
+	}
+	if n, _ := res.RowsAffected(); n == 0 {
+		return ErrOutboxEventNotFound
+	}
+	if _, err := tx.Exec(`SELECT pg_notify('outbox_events_new', '')`); err != nil {
+		return fmt.Errorf("notify outbox error: %w", err)
+	}
+	return tx.Commit()
+}
@@ -0,0 +1,56 @@
+package repository
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"payment-service/internal/domain"
+	"time"
+)
+
+const (
+	DefaultTransactionsPageSize = 20
+	MaxTransactionsPageSize     = 100
+)
+
+var ErrInvalidCursor = errors.New("invalid cursor")
+
+// TransactionFilter selects one page of a user's account history. Nil bounds
+// are not applied.
+type TransactionFilter struct {
+	UserID      int64
+	Kinds       []domain.TransactionKind
+	CreatedFrom *time.Time
+	CreatedTo   *time.Time
+	Limit       int
+	After       *TransactionCursor
+}
+
+// TransactionCursor points at the last entry of a page. Entries are listed by
+// (created_at, id) descending, so the next page starts strictly below it.
+type TransactionCursor struct {
+	CreatedAt time.Time `json:"created_at"`
+	ID        int64     `json:"id"`
+}
+
+type TransactionPage struct {
+	Transactions []domain.Transaction `json:"transactions"`
+	NextCursor   string               `json:"next_cursor,omitempty"`
+}
+
+func (c TransactionCursor) Encode() string {
+	b, _ := json.Marshal(c)
+	return base64.RawURLEncoding.EncodeToString(b)
+}
+
+func DecodeTransactionCursor(s string) (*TransactionCursor, error) {
+	b, err := base64.RawURLEncoding.DecodeString(s)
+	if err != nil {
+		return nil, ErrInvalidCursor
+	}
+	c := &TransactionCursor{}
+	if err := json.Unmarshal(b, c); err != nil || c.ID <= 0 {
+		return nil, ErrInvalidCursor
+	}
+	return c, nil
+}
@@ -0,0 +1,33 @@
+package repository
+
+import (
+	"encoding/base64"
+	"errors"
+	"testing"
+	"time"
+)
+
+func TestTransactionCursorRoundTrip(t *testing.T) {
+	c := TransactionCursor{CreatedAt: time.Date(2026, 1, 2, 3, 4, 5, 678900000, time.UTC), ID: 42}
+	got, err := DecodeTransactionCursor(c.Encode())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !got.CreatedAt.Equal(c.CreatedAt) || got.ID != c.ID {
+		t.Fatalf("DecodeTransactionCursor(Encode(%+v)) = %+v", c, *got)
+	}
+}
+
+func TestDecodeTransactionCursorRejectsGarbage(t *testing.T) {
+	for _, s := range []string{
+		"",
+		"not base64!",
+		base64.RawURLEncoding.EncodeToString([]byte("not json")),
+		base64.RawURLEncoding.EncodeToString([]byte(`{"created_at":"2026-01-02T00:00:00Z"}`)),
+		base64.RawURLEncoding.EncodeToString([]byte(`{"created_at":"2026-01-02T00:00:00Z","id":-1}`)),
+	} {
+		if _, err := DecodeTransactionCursor(s); !errors.Is(err, ErrInvalidCursor) {
+			t.Errorf("DecodeTransactionCursor(%q): got %v, want ErrInvalidCursor", s, err)
+		}
+	}
+}
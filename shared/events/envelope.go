@@ -0,0 +1,123 @@
+// Package events defines the envelope every event exchanged between the
+// services is wrapped in.
+package events
+
+import (
+	"crypto/rand"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+	"unicode"
+)
+
+// SchemaVersion is bumped whenever the shape of Envelope.Data changes in a
+// way consumers have to know about.
+const SchemaVersion = 1
+
+var ErrInvalidEnvelope = errors.New("invalid event envelope")
+
+// ErrUnsupportedVersion means the envelope was written with a schema version
+// this build does not know.
+var ErrUnsupportedVersion = errors.New("unsupported event schema version")
+
+// Envelope wraps every event exchanged between services. CorrelationID is
+// shared by all events of one checkout and starts as the event id of its
+// OrderCreated; CausationID is the event id of the event that directly caused
+// this one.
+type Envelope struct {
+	EventID       string          `json:"event_id"`
+	EventType     string          `json:"event_type"`
+	SchemaVersion int             `json:"schema_version"`
+	OccurredAt    time.Time       `json:"occurred_at"`
+	CorrelationID string          `json:"correlation_id"`
+	CausationID   string          `json:"causation_id,omitempty"`
+	Data          json.RawMessage `json:"data"`
+}
+
+// New builds an envelope around data. An empty correlationID starts a new
+// correlation with the event's own id.
+func New(eventType string, data interface{}, correlationID, causationID string) (Envelope, error) {
+	raw, err := json.Marshal(data)
+	if err != nil {
+		return Envelope{}, fmt.Errorf("marshal %s data: %w", eventType, err)
+	}
+	id := NewID()
+	if correlationID == "" {
+		correlationID = id
+	}
+	return Envelope{
+		EventID:       id,
+		EventType:     eventType,
+		SchemaVersion: SchemaVersion,
+		OccurredAt:    time.Now().UTC(),
+		CorrelationID: correlationID,
+		CausationID:   causationID,
+		Data:          raw,
+	}, nil
+}
+
+// Parse reads an envelope from a message body. Bodies published before the
+// envelope was introduced are bare data objects; they are wrapped using
+// fallbackType (the AMQP Type) and fallbackID (the AMQP MessageId). An
+// envelope of any other schema version than SchemaVersion is rejected with
+// ErrUnsupportedVersion, since its data may not mean what this build expects.
+func Parse(body []byte, fallbackType, fallbackID string) (Envelope, error) {
+	var env Envelope
+	if err := json.Unmarshal(body, &env); err != nil {
+		return Envelope{}, fmt.Errorf("%w: %v", ErrInvalidEnvelope, err)
+	}
+	if env.EventID == "" && env.EventType == "" && env.Data == nil {
+		return Envelope{
+			EventID:       fallbackID,
+			EventType:     fallbackType,
+			CorrelationID: fallbackID,
+			Data:          json.RawMessage(body),
+		}, nil
+	}
+	if env.EventID == "" || env.EventType == "" || env.Data == nil {
+		return Envelope{}, fmt.Errorf("%w: missing event_id, event_type or data", ErrInvalidEnvelope)
+	}
+	if env.SchemaVersion != SchemaVersion {
+		return Envelope{}, fmt.Errorf("%w: %d", ErrUnsupportedVersion, env.SchemaVersion)
+	}
+	return env, nil
+}
+
+func (e Envelope) Decode(v interface{}) error {
+	if err := json.Unmarshal(e.Data, v); err != nil {
+		return fmt.Errorf("decode %s data: %w", e.EventType, err)
+	}
+	return nil
+}
+
+// RoutingKey is the topic routing key events of eventType are published
+// with: the words of the type in lower case, separated by dots, with the
+// first one in plural. OrderCreated becomes orders.created and
+// PaymentSucceeded becomes payments.succeeded.
+func RoutingKey(eventType string) string {
+	if eventType == "" {
+		return ""
+	}
+	var words []string
+	start := 0
+	for i, r := range eventType {
+		if i > 0 && unicode.IsUpper(r) {
+			words = append(words, strings.ToLower(eventType[start:i]))
+			start = i
+		}
+	}
+	words = append(words, strings.ToLower(eventType[start:]))
+	words[0] += "s"
+	return strings.Join(words, ".")
+}
+
+// NewID returns a random RFC 4122 version 4 UUID.
+func NewID() string {
+	var b [16]byte
+	_, _ = rand.Read(b[:])
+	b[6] = (b[6] & 0x0f) | 0x40
+	b[8] = (b[8] & 0x3f) | 0x80
+	return fmt.Sprintf("%x-%x-%x-%x-%x", b[0:4], b[4:6], b[6:8], b[8:10], b[10:16])
+}
@@ -0,0 +1,70 @@
+package events
+
+import (
+	"encoding/json"
+	"errors"
+	"testing"
+)
+
+func TestParse(t *testing.T) {
+	env, err := New("OrderCreated", map[string]int{"order_id": 1}, "", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	body, err := json.Marshal(env)
+	if err != nil {
+		t.Fatal(err)
+	}
+	got, err := Parse(body, "", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got.EventID != env.EventID || got.CorrelationID != env.EventID || got.SchemaVersion != SchemaVersion {
+		t.Fatalf("Parse returned %+v, want %+v", got, env)
+	}
+
+	// A bare body from before the envelope takes its type and id from the
+	// AMQP properties.
+	got, err = Parse([]byte(`{"order_id": 1}`), "OrderCreated", "legacy-id")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got.EventType != "OrderCreated" || got.EventID != "legacy-id" || got.CorrelationID != "legacy-id" {
+		t.Fatalf("Parse of a bare body returned %+v", got)
+	}
+
+	for _, version := range []int{0, SchemaVersion + 1} {
+		env.SchemaVersion = version
+		body, err := json.Marshal(env)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err := Parse(body, "", ""); !errors.Is(err, ErrUnsupportedVersion) {
+			t.Errorf("Parse of schema version %d: got %v, want ErrUnsupportedVersion", version, err)
+		}
+	}
+
+	for _, body := range []string{`not json`, `{"event_id": "x", "data": {}}`} {
+		if _, err := Parse([]byte(body), "", ""); !errors.Is(err, ErrInvalidEnvelope) {
+			t.Errorf("Parse(%s): got %v, want ErrInvalidEnvelope", body, err)
+		}
+	}
+}
+
+func TestRoutingKey(t *testing.T) {
+	tests := map[string]string{
+		"OrderCreated":      "orders.created",
+		"OrderCancelled":    "orders.cancelled",
+		"PaymentSucceeded":  "payments.succeeded",
+		"PaymentRefunded":   "payments.refunded",
+		"TransferCompleted": "transfers.completed",
+		"AccountWithdrawn":  "accounts.withdrawn",
+		"Ping":              "pings",
+		"":                  "",
+	}
+	for eventType, want := range tests {
+		if got := RoutingKey(eventType); got != want {
+			t.Errorf("RoutingKey(%q) = %q, want %q", eventType, got, want)
+		}
+	}
+}
@@ -0,0 +1,183 @@
+// Package idempotency replays the stored response to requests that repeat
+// an Idempotency-Key.
+package idempotency
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"time"
+)
+
+const (
+	HeaderKey      = "Idempotency-Key"
+	HeaderReplayed = "Idempotent-Replayed"
+
+	maxKeyLength = 255
+)
+
+// Store remembers the response to every request that carried an
+// Idempotency-Key, so that a retry of the same request gets the original
+// response back instead of being executed again.
+type Store struct {
+	db *sql.DB
+	// table is where the keys and responses are kept.
+	table string
+	// lockTimeout is how long a key stays claimed by a request that never
+	// finished (e.g. the service crashed mid-request) before a retry may take it over.
+	lockTimeout time.Duration
+}
+
+func NewStore(db *sql.DB, table string, lockTimeout time.Duration) *Store {
+	return &Store{db: db, table: table, lockTimeout: lockTimeout}
+}
+
+// Middleware makes next idempotent for requests with an Idempotency-Key header.
+// The key is claimed before next runs; a retry with the same key and body
+// replays the stored response, the same key with a different body gets 422,
+// and a retry while the first request is still running gets 409.
+// 5xx responses are not stored, so the client can retry them.
+func (s *Store) Middleware(scope string, next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		key := r.Header.Get(HeaderKey)
+		if key == "" {
+			next(w, r)
+			return
+		}
+		if len(key) > maxKeyLength {
+			http.Error(w, "Idempotency-Key is too long", http.StatusBadRequest)
+			return
+		}
+		body, err := io.ReadAll(r.Body)
+		if err != nil {
+			http.Error(w, "failed to read request body", http.StatusBadRequest)
+			return
+		}
+		r.Body = io.NopCloser(bytes.NewReader(body))
+		sum := sha256.Sum256(body)
+		fingerprint := hex.EncodeToString(sum[:])
+
+		claimed, err := s.claim(key, scope, fingerprint, w)
+		if err != nil {
+			log.Printf("%s: claim error for key %s: %v", s.table, key, err)
+			http.Error(w, "failed to check Idempotency-Key", http.StatusInternalServerError)
+			return
+		}
+		if !claimed {
+			return
+		}
+
+		rec := &responseRecorder{header: make(http.Header), code: http.StatusOK}
+		next(rec, r)
+
+		if rec.code >= http.StatusInternalServerError {
+			if _, err := s.db.Exec(fmt.Sprintf(`DELETE FROM %s WHERE key = $1 AND scope = $2`, s.table), key, scope); err != nil {
+				log.Printf("%s: release error for key %s: %v", s.table, key, err)
+			}
+		} else {
+			_, err := s.db.Exec(fmt.Sprintf(`
+				UPDATE %s
+				SET status = 'completed', response_code = $1, response_body = $2,
+				    response_content_type = $3, completed_at = NOW()
+				WHERE key = $4 AND scope = $5
+			`, s.table), rec.code, rec.body.Bytes(), rec.header.Get("Content-Type"), key, scope)
+			if err != nil {
+				log.Printf("%s: save response error for key %s: %v", s.table, key, err)
+			}
+		}
+		rec.writeTo(w)
+	}
+}
+
+// claim reserves key for the current request. When it returns false the
+// response (a replay or an error) has already been written to w.
+func (s *Store) claim(key, scope, fingerprint string, w http.ResponseWriter) (bool, error) {
+	res, err := s.db.Exec(fmt.Sprintf(`
+		INSERT INTO %s (key, scope, fingerprint, status)
+		VALUES ($1, $2, $3, 'processing')
+		ON CONFLICT (key, scope) DO NOTHING
+	`, s.table), key, scope, fingerprint)
+	if err != nil {
+		return false, err
+	}
+	if n, _ := res.RowsAffected(); n == 1 {
+		return true, nil
+	}
+
+	var storedFingerprint, status string
+	var code sql.NullInt64
+	var body []byte
+	var contentType sql.NullString
+	err = s.db.QueryRow(fmt.Sprintf(`
+		SELECT fingerprint, status, response_code, response_body, response_content_type
+		FROM %s
+		WHERE key = $1 AND scope = $2
+	`, s.table), key, scope).Scan(&storedFingerprint, &status, &code, &body, &contentType)
+	if err == sql.ErrNoRows {
+		// The first request failed and released the key in the meantime.
+		return s.claim(key, scope, fingerprint, w)
+	}
+	if err != nil {
+		return false, err
+	}
+	if storedFingerprint != fingerprint {
+		http.Error(w, "Idempotency-Key was already used with a different request body", http.StatusUnprocessableEntity)
+		return false, nil
+	}
+	if status == "completed" {
+		if contentType.Valid && contentType.String != "" {
+			w.Header().Set("Content-Type", contentType.String)
+		}
+		w.Header().Set(HeaderReplayed, "true")
+		w.WriteHeader(int(code.Int64))
+		_, _ = w.Write(body)
+		return false, nil
+	}
+
+	res, err = s.db.Exec(fmt.Sprintf(`
+		UPDATE %s
+		SET locked_at = NOW()
+		WHERE key = $1 AND scope = $2 AND status = 'processing'
+		  AND locked_at < NOW() - make_interval(secs => $3)
+	`, s.table), key, scope, s.lockTimeout.Seconds())
+	if err != nil {
+		return false, err
+	}
+	if n, _ := res.RowsAffected(); n == 1 {
+		log.Printf("%s: took over stale key %s", s.table, key)
+		return true, nil
+	}
+	http.Error(w, "a request with this Idempotency-Key is still being processed", http.StatusConflict)
+	return false, nil
+}
+
+type responseRecorder struct {
+	header http.Header
+	code   int
+	body   bytes.Buffer
+}
+
+func (r *responseRecorder) Header() http.Header {
+	return r.header
+}
+
+func (r *responseRecorder) WriteHeader(code int) {
+	r.code = code
+}
+
+func (r *responseRecorder) Write(b []byte) (int, error) {
+	return r.body.Write(b)
+}
+
+func (r *responseRecorder) writeTo(w http.ResponseWriter) {
+	for k, v := range r.header {
+		w.Header()[k] = v
+	}
+	w.WriteHeader(r.code)
+	_, _ = w.Write(r.body.Bytes())
+}
@@ -0,0 +1,45 @@
+package outbox
+
+import (
+	"encoding/json"
+	"sync"
+	"time"
+)
+
+// LatencyStats tracks how long events wait in the outbox between the insert
+// and the publish. It is exported through expvar under /debug/vars.
+type LatencyStats struct {
+	mu    sync.Mutex
+	count int64
+	total time.Duration
+	max   time.Duration
+	last  time.Duration
+}
+
+// Observe records that an event waited d before it was published.
+func (s *LatencyStats) Observe(d time.Duration) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.count++
+	s.total += d
+	s.last = d
+	if d > s.max {
+		s.max = d
+	}
+}
+
+func (s *LatencyStats) String() string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	var avg time.Duration
+	if s.count > 0 {
+		avg = s.total / time.Duration(s.count)
+	}
+	b, _ := json.Marshal(map[string]interface{}{
+		"count":   s.count,
+		"avg_ms":  avg.Milliseconds(),
+		"max_ms":  s.max.Milliseconds(),
+		"last_ms": s.last.Milliseconds(),
+	})
+	return string(b)
+}
@@ -0,0 +1,30 @@
+// Package outbox holds what the outbox processors of the services share:
+// the retry schedule of failed rows and the dispatch latency statistics.
+package outbox
+
+import (
+	"math/rand/v2"
+	"time"
+)
+
+const (
+	// MaxAttempts is how many times a row is published before it is marked
+	// failed and left for an operator to requeue.
+	MaxAttempts = 10
+	baseBackoff = time.Second
+	maxBackoff  = 5 * time.Minute
+)
+
+// Backoff returns the delay before attempt number attempts+1: exponential in
+// the number of failed attempts, capped at maxBackoff, with the upper half
+// jittered so that rows failing together do not retry in lockstep.
+func Backoff(attempts int) time.Duration {
+	d := maxBackoff
+	if attempts < 1 {
+		d = baseBackoff
+	} else if attempts < 20 {
+		d = min(baseBackoff<<(attempts-1), maxBackoff)
+	}
+	half := d / 2
+	return half + rand.N(half+1)
+}
@@ -0,0 +1,37 @@
+package outbox
+
+import (
+	"testing"
+	"time"
+)
+
+func TestBackoff(t *testing.T) {
+	tests := []struct {
+		attempts int
+		max      time.Duration
+	}{
+		{0, baseBackoff},
+		{1, baseBackoff},
+		{2, 2 * baseBackoff},
+		{3, 4 * baseBackoff},
+		{9, 256 * baseBackoff},
+		{10, maxBackoff},
+		{19, maxBackoff},
+		// Large counts must not overflow the shift.
+		{64, maxBackoff},
+	}
+	for _, tt := range tests {
+		// The delay is jittered over the upper half of [0, max].
+		lowest, highest := tt.max, time.Duration(0)
+		for i := 0; i < 200; i++ {
+			d := Backoff(tt.attempts)
+			if d < tt.max/2 || d > tt.max {
+				t.Fatalf("Backoff(%d) = %s, want within [%s, %s]", tt.attempts, d, tt.max/2, tt.max)
+			}
+			lowest, highest = min(lowest, d), max(highest, d)
+		}
+		if lowest == highest {
+			t.Errorf("Backoff(%d) always returned %s, want jitter", tt.attempts, lowest)
+		}
+	}
+}
@@ -0,0 +1,150 @@
+// Package retention removes old processed rows from an outbox table.
+package retention
+
+import (
+	"database/sql"
+	"expvar"
+	"fmt"
+	"log"
+	"time"
+)
+
+// Table describes the outbox table of a service and its archive.
+type Table struct {
+	Name string
+	// Archive is a table partitioned by range of archived_at.
+	Archive string
+	// TypeColumn holds the event type of a row.
+	TypeColumn string
+}
+
+type Config struct {
+	// MaxAge is how long processed outbox rows are kept in the outbox table.
+	MaxAge time.Duration
+	// Archive moves old rows into the archive table; otherwise they are deleted.
+	Archive  bool
+	Interval time.Duration
+	// BatchSize keeps every statement short so the outbox processor is not
+	// blocked behind a long-running DELETE.
+	BatchSize int
+}
+
+// Job periodically removes processed rows from the outbox so the table and
+// the scans over it stay small.
+type Job struct {
+	db    *sql.DB
+	table Table
+	cfg   Config
+	stats *expvar.Map
+}
+
+func NewJob(db *sql.DB, table Table, cfg Config) *Job {
+	stats := new(expvar.Map).Init()
+	// Only the first job of the process is exported, see
+	// outbox.NewOutboxProcessor.
+	if expvar.Get("outbox_retention") == nil {
+		expvar.Publish("outbox_retention", stats)
+	}
+	return &Job{db: db, table: table, cfg: cfg, stats: stats}
+}
+
+func (j *Job) Start() {
+	go func() {
+		ticker := time.NewTicker(j.cfg.Interval)
+		for range ticker.C {
+			j.run()
+		}
+	}()
+}
+
+func (j *Job) run() {
+	if j.cfg.Archive {
+		if err := j.ensurePartitions(time.Now()); err != nil {
+			log.Printf("%s retention: partition error: %v", j.table.Name, err)
+			return
+		}
+	}
+	total := 0
+	for {
+		n, err := j.runBatch()
+		if err != nil {
+			log.Printf("%s retention: %v", j.table.Name, err)
+			break
+		}
+		total += n
+		if n < j.cfg.BatchSize {
+			break
+		}
+	}
+	j.stats.Add("runs", 1)
+	j.stats.Add("rows_total", int64(total))
+	last := new(expvar.Int)
+	last.Set(int64(total))
+	j.stats.Set("rows_last_run", last)
+	if total > 0 {
+		action := "deleted"
+		if j.cfg.Archive {
+			action = "archived"
+		}
+		log.Printf("%s retention: %s %d processed rows older than %s", j.table.Name, action, total, j.cfg.MaxAge)
+	}
+}
+
+// expiredRows deletes one batch of old processed rows and exposes them to
+// the statement that follows it.
+func (j *Job) expiredRows() string {
+	return fmt.Sprintf(`
+	WITH expired AS (
+		DELETE FROM %[1]s
+		WHERE id IN (
+			SELECT id FROM %[1]s
+			WHERE status = 'processed'
+			  AND COALESCE(processed_at, created_at) < NOW() - make_interval(secs => $1)
+			ORDER BY id
+			LIMIT $2
+			FOR UPDATE SKIP LOCKED
+		)
+		RETURNING id, event_id, trace_context, %[2]s, payload, status, attempts, last_error, created_at, processed_at
+	)`, j.table.Name, j.table.TypeColumn)
+}
+
+func (j *Job) runBatch() (int, error) {
+	if !j.cfg.Archive {
+		var n int
+		err := j.db.QueryRow(j.expiredRows()+`
+	SELECT COUNT(*) FROM expired`, j.cfg.MaxAge.Seconds(), j.cfg.BatchSize).Scan(&n)
+		if err != nil {
+			return 0, fmt.Errorf("delete batch error: %w", err)
+		}
+		return n, nil
+	}
+	res, err := j.db.Exec(j.expiredRows()+fmt.Sprintf(`
+	INSERT INTO %[1]s (id, event_id, trace_context, %[2]s, payload, status, attempts, last_error, created_at, processed_at)
+	SELECT id, event_id, trace_context, %[2]s, payload, status, attempts, last_error, created_at, processed_at FROM expired`,
+		j.table.Archive, j.table.TypeColumn),
+		j.cfg.MaxAge.Seconds(), j.cfg.BatchSize)
+	if err != nil {
+		return 0, fmt.Errorf("archive batch error: %w", err)
+	}
+	n, _ := res.RowsAffected()
+	return int(n), nil
+}
+
+// ensurePartitions creates the monthly archive partitions for the
+// current and the next month, so archiving never hits a missing partition
+// around a month boundary. Old partitions can simply be dropped.
+func (j *Job) ensurePartitions(now time.Time) error {
+	month := time.Date(now.Year(), now.Month(), 1, 0, 0, 0, 0, time.UTC)
+	for i := 0; i < 2; i++ {
+		from := month.AddDate(0, i, 0)
+		to := from.AddDate(0, 1, 0)
+		_, err := j.db.Exec(fmt.Sprintf(`
+		CREATE TABLE IF NOT EXISTS %[1]s_%[2]s PARTITION OF %[1]s
+		FOR VALUES FROM ('%[3]s') TO ('%[4]s')`,
+			j.table.Archive, from.Format("2006_01"), from.Format("2006-01-02"), to.Format("2006-01-02")))
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,152 @@
+// Package tracing sets up OpenTelemetry for a service and carries trace
+// context through HTTP requests, outbox rows and message headers.
+package tracing
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/exporters/stdout/stdouttrace"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/sdk/resource"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	semconv "go.opentelemetry.io/otel/semconv/v1.41.0"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// tracer is replaced by Init with one named after the service.
+var tracer = otel.Tracer("gozon")
+
+// Init installs the global tracer provider and the W3C trace context
+// propagator, and names spans after serviceName. Spans are written as JSON lines to the file named by
+// OTEL_TRACES_FILE, or to stdout if it is empty; OTEL_TRACES_EXPORTER=none
+// turns exporting off but keeps propagating context. The returned function
+// flushes pending spans.
+func Init(serviceName string) (func(context.Context) error, error) {
+	otel.SetTextMapPropagator(propagation.TraceContext{})
+	tracer = otel.Tracer(serviceName)
+	if os.Getenv("OTEL_TRACES_EXPORTER") == "none" {
+		return func(context.Context) error { return nil }, nil
+	}
+	var out io.Writer = os.Stdout
+	if path := os.Getenv("OTEL_TRACES_FILE"); path != "" {
+		f, err := os.OpenFile(path, os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0o644)
+		if err != nil {
+			return nil, fmt.Errorf("open traces file: %w", err)
+		}
+		out = f
+	}
+	exporter, err := stdouttrace.New(stdouttrace.WithWriter(out))
+	if err != nil {
+		return nil, fmt.Errorf("create trace exporter: %w", err)
+	}
+	provider := sdktrace.NewTracerProvider(
+		sdktrace.WithBatcher(exporter),
+		sdktrace.WithResource(resource.NewWithAttributes(semconv.SchemaURL, semconv.ServiceName(serviceName))),
+	)
+	otel.SetTracerProvider(provider)
+	return provider.Shutdown, nil
+}
+
+func Start(ctx context.Context, name string, opts ...trace.SpanStartOption) (context.Context, trace.Span) {
+	return tracer.Start(ctx, name, opts...)
+}
+
+// Fail marks span as failed with err.
+func Fail(span trace.Span, err error) {
+	span.RecordError(err)
+	span.SetStatus(codes.Error, err.Error())
+}
+
+// Marshal returns the trace context of ctx as a JSON object, for storing it
+// next to an outbox row.
+func Marshal(ctx context.Context) []byte {
+	carrier := propagation.MapCarrier{}
+	otel.GetTextMapPropagator().Inject(ctx, carrier)
+	raw, _ := json.Marshal(carrier)
+	return raw
+}
+
+// Unmarshal returns ctx extended with a trace context stored by Marshal.
+// Invalid or empty input leaves ctx unchanged.
+func Unmarshal(ctx context.Context, raw []byte) context.Context {
+	carrier := propagation.MapCarrier{}
+	if json.Unmarshal(raw, &carrier) != nil {
+		return ctx
+	}
+	return otel.GetTextMapPropagator().Extract(ctx, carrier)
+}
+
+// Headers returns message headers carrying the trace context of ctx.
+func Headers(ctx context.Context) map[string]interface{} {
+	headers := make(map[string]interface{})
+	otel.GetTextMapPropagator().Inject(ctx, headerCarrier(headers))
+	return headers
+}
+
+// FromHeaders returns ctx extended with the trace context carried in
+// message headers.
+func FromHeaders(ctx context.Context, headers map[string]interface{}) context.Context {
+	return otel.GetTextMapPropagator().Extract(ctx, headerCarrier(headers))
+}
+
+// headerCarrier adapts message headers, whose values are not necessarily
+// strings, to propagation.TextMapCarrier.
+type headerCarrier map[string]interface{}
+
+func (c headerCarrier) Get(key string) string {
+	v, _ := c[key].(string)
+	return v
+}
+
+func (c headerCarrier) Set(key, value string) {
+	c[key] = value
+}
+
+func (c headerCarrier) Keys() []string {
+	keys := make([]string, 0, len(c))
+	for k := range c {
+		keys = append(keys, k)
+	}
+	return keys
+}
+
+// Middleware starts a server span for every request, continuing the trace
+// of the caller if the request carries a traceparent header.
+func Middleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		ctx := otel.GetTextMapPropagator().Extract(r.Context(), propagation.HeaderCarrier(r.Header))
+		ctx, span := tracer.Start(ctx, r.Method+" "+r.URL.Path, trace.WithSpanKind(trace.SpanKindServer))
+		defer span.End()
+		rec := &statusRecorder{ResponseWriter: w, status: http.StatusOK}
+		r = r.WithContext(ctx)
+		next.ServeHTTP(rec, r)
+		if r.Pattern != "" {
+			span.SetName(r.Pattern)
+		}
+		span.SetAttributes(
+			attribute.String("http.request.method", r.Method),
+			attribute.Int("http.response.status_code", rec.status),
+		)
+		if rec.status >= http.StatusInternalServerError {
+			span.SetStatus(codes.Error, http.StatusText(rec.status))
+		}
+	})
+}
+
+type statusRecorder struct {
+	http.ResponseWriter
+	status int
+}
+
+func (r *statusRecorder) WriteHeader(status int) {
+	r.status = status
+	r.ResponseWriter.WriteHeader(status)
+}